@@ -20,7 +20,9 @@ func main() {
 	}
 
 	for {
-		s := fmt.Sprintf("*ZJ,2030295119,V1,%s,A,3106.3677,N,7710.9352,E,2.38,0.00,%s,00000000#\n", time.Now().Format(TIMEFORMAT), time.Now().Format(DATEFORMAT))
+		// ZJ sends the time and date in UTC, both taken from the same instant so they agree around midnight
+		now := time.Now().UTC()
+		s := fmt.Sprintf("*ZJ,2030295119,V1,%s,A,3106.3677,N,7710.9352,E,2.38,0.00,%s,00000000#\n", now.Format(TIMEFORMAT), now.Format(DATEFORMAT))
 		Conn.Write([]byte(s))
 		fmt.Println(s)
 		// fmt.Println(time.Now())
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	logging "github.com/op/go-logging"
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+)
+
+// Config is everything that differs from one deployment of the adapter to the next
+// It comes from a JSON file, then the environment, then flags, each one overriding the one before
+// The gateway access token never comes from the file or from flags, it is read from GPSADAPTER_TOKEN or from TokenFile
+type Config struct {
+	Broker     string         `json:"broker"`     // The MQTT broker URL, e.g. tcp://127.0.0.1:1883
+	TokenFile  string         `json:"tokenFile"`  // File holding the ThingsBoard access token for the gateway device
+	Listeners  []*Listener    `json:"listeners"`  // Where the GPS data is coming to
+	HTTPListen string         `json:"httpListen"` // Where to take OsmAnd reports, empty to not listen
+	Metrics    string         `json:"metrics"`    // Where to serve /debug/vars, empty to not listen
+	LogFile    string         `json:"logFile"`    // File to log to besides stderr, empty to only log to stderr
+	Profile    string         `json:"profile"`    // File to write a CPU profile to, empty to not profile
+	FixPolicy  string         `json:"fixPolicy"`  // What to do with positions without a valid GPS fix (flag, drop or last-known)
+	Schema     string         `json:"schema"`     // The output schema for published data (thingsboard, flat or geojson)
+	Topic      string         `json:"topic"`      // Flat and geojson data go to Topic/telemetry and Topic/attributes
+	Keys       gpsparser.Keys `json:"keys"`       // Telemetry keys to rename on output
+	IONames    map[int]string `json:"ioNames"`    // Telemetry keys for Teltonika IO elements, on top of those gpsparser knows
+	Devices    []string       `json:"devices"`    // The only devices whose data is published, empty to publish every device
+	RateLimit  int            `json:"rateLimit"`  // Most records published per device per minute, alerts aside, 0 for no limit
+	LogLevel   string         `json:"logLevel"`   // Least severe level logged (DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL)
+
+	// Alerts raised and muted on top of what the devices report
+	AlertRules gpsparser.AlertRules `json:"alertRules"`
+
+	Workers   int    `json:"workers"`   // How many publications are sent to the broker at once
+	QueueSize int    `json:"queueSize"` // How many publications may wait for a worker, shared out between the workers
+	Overflow  string `json:"overflow"`  // What to do with publications when the queue is full (block, drop-oldest or spill)
+	SpoolDir  string `json:"spoolDir"`  // Where publications are spilled to, for the spill overflow policy
+	SpoolSize int64  `json:"spoolSize"` // Most bytes spilled to SpoolDir, 0 for no limit
+
+	BacklogDir  string `json:"backlogDir"`  // Where records are kept while the broker cannot be reached
+	BacklogSize int64  `json:"backlogSize"` // Most bytes kept in BacklogDir, the oldest records are dropped past that, 0 for no limit
+
+	// Most milliseconds a record put in the spool or the backlog waits to be flushed to disk, 0 to flush every record
+	SyncInterval int `json:"syncInterval"`
+
+	// Worked out by validate
+	token     string
+	fixPolicy gpsparser.FixPolicy
+	encoder   gpsparser.Encoder
+	logLevel  logging.Level
+}
+
+// defaultConfig is what the adapter runs with when nothing else is said, everything but the token
+func defaultConfig() *Config {
+	return &Config{
+		Broker: "tcp://127.0.0.1:1883",
+		// Every vendor gets its own port with its protocol fixed
+		// The legacy port 8000 detects the protocol from the data, for the old fleet and the client simulator
+		Listeners: []*Listener{
+			{Transport: "tcp", Addr: "0.0.0.0:8000", Protocol: "auto"},
+			{Transport: "udp", Addr: "0.0.0.0:8000", Protocol: "auto"},
+			{Transport: "tcp", Addr: "0.0.0.0:5002", Protocol: "TK103"},
+			{Transport: "tcp", Addr: "0.0.0.0:5013", Protocol: "H02"},
+			{Transport: "udp", Addr: "0.0.0.0:5013", Protocol: "H02"},
+			{Transport: "tcp", Addr: "0.0.0.0:5023", Protocol: "GT06"},
+			{Transport: "tcp", Addr: "0.0.0.0:5027", Protocol: "Teltonika"},
+		},
+		// Only served to the host itself, the counters are for us and not for the devices
+		Metrics:   "127.0.0.1:5056",
+		LogFile:   "/var/log/gpsAdapter.log",
+		FixPolicy: "flag",
+		Schema:    "thingsboard",
+		Topic:     "gpsAdapter",
+		// Our ThingsBoard dashboards expect latitude and longitude
+		Keys: gpsparser.Keys{"lat": "latitude", "lng": "longitude"},
+		// The IO elements our FMB units are configured to send
+		IONames:  map[int]string{113: "batPct", 200: "sleepMode"},
+		LogLevel: "INFO",
+		// Enough workers to hide the broker's round trips, waiting publications take about 1 KB each
+		Workers:   16,
+		QueueSize: 10000,
+		Overflow:  OverflowBlock,
+		SpoolDir:  "/var/spool/gpsAdapter/overflow",
+		SpoolSize: 1 << 30,
+		// A day of our fleet's data
+		BacklogDir:  "/var/spool/gpsAdapter/backlog",
+		BacklogSize: 4 << 30,
+		// Bursts are flushed at once, a crash of the machine loses at most the last second
+		SyncInterval: 1000,
+	}
+}
+
+// loadConfig builds the configuration from the file given with -config (or GPSADAPTER_CONFIG), the environment and args
+func loadConfig(args []string) (*Config, error) {
+	config := defaultConfig()
+
+	// The settings that can also be given in the environment or as flags
+	// value points to a string, an int, an int64 or the listeners, see setValue
+	settings := []struct {
+		flag  string
+		env   string
+		value interface{}
+		usage string
+	}{
+		{"broker", "GPSADAPTER_BROKER", &config.Broker, "MQTT broker URL"},
+		{"listen", "GPSADAPTER_LISTEN", &config.Listeners, "listeners as transport://addr/protocol separated by commas, e.g. tcp://0.0.0.0:5023/GT06,udp://0.0.0.0:8000"},
+		{"token-file", "GPSADAPTER_TOKEN_FILE", &config.TokenFile, "file holding the gateway access token"},
+		{"http", "GPSADAPTER_HTTP", &config.HTTPListen, "address for OsmAnd reports, empty to not listen"},
+		{"metrics", "GPSADAPTER_METRICS", &config.Metrics, "address for /debug/vars, empty to not listen"},
+		{"log", "GPSADAPTER_LOG", &config.LogFile, "file to log to besides stderr, empty for none"},
+		{"profile", "GPSADAPTER_PROFILE", &config.Profile, "file to write a CPU profile to, empty for none"},
+		{"fix-policy", "GPSADAPTER_FIX_POLICY", &config.FixPolicy, "what to do with positions without a GPS fix: flag, drop or last-known"},
+		{"schema", "GPSADAPTER_SCHEMA", &config.Schema, "output schema: thingsboard, flat or geojson"},
+		{"topic", "GPSADAPTER_TOPIC", &config.Topic, "topic prefix for the flat and geojson schemas"},
+		{"log-level", "GPSADAPTER_LOG_LEVEL", &config.LogLevel, "least severe level logged: DEBUG, INFO, NOTICE, WARNING, ERROR or CRITICAL"},
+		{"overflow", "GPSADAPTER_OVERFLOW", &config.Overflow, "what to do when the publication queue is full: block, drop-oldest or spill"},
+		{"spool", "GPSADAPTER_SPOOL", &config.SpoolDir, "directory to spill publications to"},
+		{"backlog", "GPSADAPTER_BACKLOG", &config.BacklogDir, "directory to keep records in while the broker cannot be reached"},
+		{"rate-limit", "GPSADAPTER_RATE_LIMIT", &config.RateLimit, "most records published per device per minute, 0 for no limit"},
+		{"workers", "GPSADAPTER_WORKERS", &config.Workers, "how many publications are sent to the broker at once"},
+		{"queue-size", "GPSADAPTER_QUEUE_SIZE", &config.QueueSize, "how many publications may wait for a worker"},
+		{"spool-size", "GPSADAPTER_SPOOL_SIZE", &config.SpoolSize, "most bytes spilled to the spool, 0 for no limit"},
+		{"backlog-size", "GPSADAPTER_BACKLOG_SIZE", &config.BacklogSize, "most bytes kept in the backlog, 0 for no limit"},
+		{"sync-interval", "GPSADAPTER_SYNC_INTERVAL", &config.SyncInterval, "most milliseconds before records on disk are flushed, 0 to flush every record"},
+	}
+
+	flags := flag.NewFlagSet("gpsAdapter", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("GPSADAPTER_CONFIG"), "JSON configuration file")
+	values := make([]*string, len(settings))
+	for i, s := range settings {
+		values[i] = flags.String(s.flag, "", s.usage+" ($"+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := config.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := setValue(s.value, v); err != nil {
+				return nil, fmt.Errorf("%s: %s", s.env, err)
+			}
+		}
+	}
+	// Only the flags that were given, so that they can also be used to clear a setting
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for i, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if err = setValue(s.value, *values[i]); err != nil {
+					err = fmt.Errorf("-%s: %s", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.validate()
+}
+
+// setValue sets the setting value points to from v, as given in the environment or as a flag
+func setValue(value interface{}, v string) error {
+	var err error
+	switch value := value.(type) {
+	case *string:
+		*value = v
+	case *int:
+		*value, err = strconv.Atoi(v)
+	case *int64:
+		*value, err = strconv.ParseInt(v, 10, 64)
+	case *[]*Listener:
+		*value, err = parseListeners(v)
+	default:
+		panic(fmt.Sprintf("setting of type %T", value))
+	}
+	return err
+}
+
+// readFile reads the JSON configuration file at path over config
+// Settings missing from the file are left as they are, listeners, keys and ioNames given replace the ones already there
+func (config *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// JSON decodes into the slices and maps already there, which would mix the file's entries with the defaults
+	// They are set aside instead and only put back when the file does not have them
+	listeners, keys, ioNames := config.Listeners, config.Keys, config.IONames
+	config.Listeners, config.Keys, config.IONames = nil, nil, nil
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if config.Listeners == nil {
+		config.Listeners = listeners
+	}
+	if config.Keys == nil {
+		config.Keys = keys
+	}
+	if config.IONames == nil {
+		config.IONames = ioNames
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// validate checks every setting, so that a bad configuration stops the adapter at startup and not hours later
+func (config *Config) validate() error {
+	broker, err := url.Parse(config.Broker)
+	if err != nil {
+		return fmt.Errorf("broker: %s", err)
+	}
+	switch broker.Scheme {
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return fmt.Errorf("broker %q: must be a tcp, ssl, ws or wss URL", config.Broker)
+	}
+
+	// The token is the gateway's password, it must not end up in the configuration file or in ps
+	config.token = os.Getenv("GPSADAPTER_TOKEN")
+	if config.token == "" && config.TokenFile != "" {
+		token, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("token file: %s", err)
+		}
+		config.token = strings.TrimSpace(string(token))
+	}
+	if config.token == "" {
+		return errors.New("no access token, set GPSADAPTER_TOKEN or tokenFile")
+	}
+
+	if len(config.Listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	seen := make(map[string]bool)
+	for _, l := range config.Listeners {
+		if err := l.validate(); err != nil {
+			return err
+		}
+		key := l.Transport + "://" + l.Addr
+		if seen[key] {
+			return fmt.Errorf("listener %s: address listed twice", l)
+		}
+		seen[key] = true
+	}
+
+	if config.fixPolicy, err = gpsparser.ParseFixPolicy(config.FixPolicy); err != nil {
+		return err
+	}
+	if config.encoder, err = gpsparser.NewEncoder(config.Schema, config.Keys, config.Topic); err != nil {
+		return err
+	}
+	if config.logLevel, err = logging.LogLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("logLevel %q: %s", config.LogLevel, err)
+	}
+	if config.RateLimit < 0 {
+		return fmt.Errorf("rateLimit %d: must not be negative", config.RateLimit)
+	}
+	if config.AlertRules.OverSpeed < 0 {
+		return fmt.Errorf("alertRules: overSpeed %d must not be negative", config.AlertRules.OverSpeed)
+	}
+
+	if config.Workers < 1 {
+		return fmt.Errorf("workers %d: must be at least 1", config.Workers)
+	}
+	if config.QueueSize < 1 {
+		return fmt.Errorf("queueSize %d: must be at least 1", config.QueueSize)
+	}
+	switch config.Overflow {
+	case OverflowBlock, OverflowDropOldest:
+	case OverflowSpill:
+		if config.SpoolDir == "" {
+			return errors.New("overflow spill: no spoolDir")
+		}
+	default:
+		return fmt.Errorf("overflow %q: must be block, drop-oldest or spill", config.Overflow)
+	}
+	if config.SpoolSize < 0 {
+		return fmt.Errorf("spoolSize %d: must not be negative", config.SpoolSize)
+	}
+	if config.BacklogDir == "" {
+		return errors.New("no backlogDir")
+	}
+	if config.Overflow == OverflowSpill && filepath.Clean(config.BacklogDir) == filepath.Clean(config.SpoolDir) {
+		return errors.New("backlogDir and spoolDir must not be the same directory")
+	}
+	if config.BacklogSize < 0 {
+		return fmt.Errorf("backlogSize %d: must not be negative", config.BacklogSize)
+	}
+	if config.SyncInterval < 0 {
+		return fmt.Errorf("syncInterval %d: must not be negative", config.SyncInterval)
+	}
+	return nil
+}
+
+// apply puts the settings that can change while the adapter runs into effect, see reload
+func (config *Config) apply() {
+	logging.SetLevel(config.logLevel, "")
+	gpsparser.SetFixPolicy(config.fixPolicy)
+	gpsparser.SetEncoder(config.encoder)
+	gpsparser.SetIONames(config.IONames)
+	gpsparser.SetAlertRules(config.AlertRules)
+	setDeviceFilter(config.Devices, config.RateLimit)
+}
+
+// reload loads the configuration again with the same arguments and applies every setting that can change while running
+// Device connections and the MQTT session are kept, settings that need them to be set up again are only reported
+// An invalid configuration is reported and the adapter keeps running with the one it has
+func reload(args []string) {
+	next, err := loadConfig(args)
+	if err != nil {
+		log.Errorf("Configuration not reloaded: %s", err)
+		return
+	}
+
+	changed := false
+	for _, s := range config.changes(next) {
+		// The token is not logged, and neither is anything else that is not applied
+		if !s.reloadable {
+			log.Warningf("Configuration: %s changed, restart to apply", s.name)
+			continue
+		}
+		log.Noticef("Configuration: %s changed from %v to %v", s.name, s.old, s.new)
+		changed = true
+	}
+	if !changed {
+		log.Notice("Configuration reloaded, nothing to apply")
+		return
+	}
+
+	// The running listeners, broker and files stay as they were started
+	config.FixPolicy, config.fixPolicy = next.FixPolicy, next.fixPolicy
+	config.Schema, config.Topic, config.Keys, config.encoder = next.Schema, next.Topic, next.Keys, next.encoder
+	config.IONames = next.IONames
+	config.Devices, config.RateLimit = next.Devices, next.RateLimit
+	config.LogLevel, config.logLevel = next.LogLevel, next.logLevel
+	config.AlertRules = next.AlertRules
+	config.apply()
+	log.Notice("Configuration reloaded")
+}
+
+// A setting that differs between two configurations
+type settingChange struct {
+	name       string
+	old, new   interface{}
+	reloadable bool // Whether it can be applied without a restart
+}
+
+// changes returns every setting that differs in next, in the order they are reported
+func (config *Config) changes(next *Config) []settingChange {
+	settings := []settingChange{
+		{"broker", config.Broker, next.Broker, false},
+		{"token", config.token, next.token, false},
+		{"listeners", listenerNames(config.Listeners), listenerNames(next.Listeners), false},
+		{"httpListen", config.HTTPListen, next.HTTPListen, false},
+		{"metrics", config.Metrics, next.Metrics, false},
+		{"logFile", config.LogFile, next.LogFile, false},
+		{"profile", config.Profile, next.Profile, false},
+		{"workers", config.Workers, next.Workers, false},
+		{"queueSize", config.QueueSize, next.QueueSize, false},
+		{"overflow", config.Overflow, next.Overflow, false},
+		{"spoolDir", config.SpoolDir, next.SpoolDir, false},
+		{"spoolSize", config.SpoolSize, next.SpoolSize, false},
+		{"backlogDir", config.BacklogDir, next.BacklogDir, false},
+		{"backlogSize", config.BacklogSize, next.BacklogSize, false},
+		{"syncInterval", config.SyncInterval, next.SyncInterval, false},
+		{"fixPolicy", config.FixPolicy, next.FixPolicy, true},
+		{"schema", config.Schema, next.Schema, true},
+		{"topic", config.Topic, next.Topic, true},
+		{"keys", config.Keys, next.Keys, true},
+		{"ioNames", config.IONames, next.IONames, true},
+		{"devices", config.Devices, next.Devices, true},
+		{"rateLimit", config.RateLimit, next.RateLimit, true},
+		{"logLevel", config.LogLevel, next.LogLevel, true},
+		{"alertRules", config.AlertRules, next.AlertRules, true},
+	}
+	var changes []settingChange
+	for _, s := range settings {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changes = append(changes, s)
+		}
+	}
+	return changes
+}
+
+// listenerNames names every listener, so listener lists can be compared and logged
+func listenerNames(listeners []*Listener) []string {
+	names := make([]string, len(listeners))
+	for i, l := range listeners {
+		names[i] = l.String()
+		if l.Device != "" {
+			names[i] += " device " + l.Device
+		}
+	}
+	return names
+}
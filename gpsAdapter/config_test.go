@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setenv sets the environment variables in env until the end of the test
+func setenv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpsAdapter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gpsAdapter.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"broker": "tcp://file:1883",
+		"workers": 4,
+		"queueSize": 100,
+		"listeners": [{"transport": "tcp", "addr": "0.0.0.0:6000", "protocol": "GT06"}]
+	}`), 0600))
+	setenv(t, map[string]string{"GPSADAPTER_TOKEN": "secret", "GPSADAPTER_CONFIG": path})
+
+	listeners := func(config *Config) []string {
+		var names []string
+		for _, l := range config.Listeners {
+			names = append(names, l.Transport+"://"+l.Addr+"/"+l.Protocol)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		args      []string
+		broker    string
+		workers   int
+		queueSize int
+		listeners []string
+	}{
+		{
+			name:      "file",
+			broker:    "tcp://file:1883",
+			workers:   4,
+			queueSize: 100,
+			listeners: []string{"tcp://0.0.0.0:6000/GT06"},
+		},
+		{
+			name:      "environment over file",
+			env:       map[string]string{"GPSADAPTER_BROKER": "tcp://env:1883", "GPSADAPTER_WORKERS": "8", "GPSADAPTER_LISTEN": "udp://0.0.0.0:7000"},
+			broker:    "tcp://env:1883",
+			workers:   8,
+			queueSize: 100,
+			listeners: []string{"udp://0.0.0.0:7000/auto"},
+		},
+		{
+			name:      "flags over environment",
+			env:       map[string]string{"GPSADAPTER_BROKER": "tcp://env:1883", "GPSADAPTER_WORKERS": "8", "GPSADAPTER_LISTEN": "udp://0.0.0.0:7000"},
+			args:      []string{"-broker", "tcp://flag:1883", "-workers", "2", "-listen", "tcp://0.0.0.0:5023/GT06, tcp://0.0.0.0:5027/Teltonika"},
+			broker:    "tcp://flag:1883",
+			workers:   2,
+			queueSize: 100,
+			listeners: []string{"tcp://0.0.0.0:5023/GT06", "tcp://0.0.0.0:5027/Teltonika"},
+		},
+		{
+			name:      "flags without environment",
+			args:      []string{"-queue-size", "50"},
+			broker:    "tcp://file:1883",
+			workers:   4,
+			queueSize: 50,
+			listeners: []string{"tcp://0.0.0.0:6000/GT06"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, test.env)
+			config, err := loadConfig(test.args)
+			require.NoError(t, err)
+			assert.Equal(t, test.broker, config.Broker)
+			assert.Equal(t, test.workers, config.Workers)
+			assert.Equal(t, test.queueSize, config.QueueSize)
+			assert.Equal(t, test.listeners, listeners(config))
+		})
+	}
+}
+
+func TestLoadConfigBadValues(t *testing.T) {
+	setenv(t, map[string]string{"GPSADAPTER_TOKEN": "secret"})
+
+	for _, args := range [][]string{
+		{"-workers", "many"},
+		{"-spool-size", "1GB"},
+		{"-listen", "0.0.0.0:5023"},
+		{"-listen", "tcp://0.0.0.0:5023/NoSuchProtocol"},
+	} {
+		_, err := loadConfig(args)
+		assert.Error(t, err, "%v", args)
+	}
+
+	setenv(t, map[string]string{"GPSADAPTER_QUEUE_SIZE": "lots"})
+	_, err := loadConfig(nil)
+	assert.EqualError(t, err, `GPSADAPTER_QUEUE_SIZE: strconv.Atoi: parsing "lots": invalid syntax`)
+}
+
+func TestConfigChanges(t *testing.T) {
+	setenv(t, map[string]string{"GPSADAPTER_TOKEN": "secret"})
+	config, err := loadConfig(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		args       []string
+		reloadable []string
+		restart    []string
+	}{
+		{name: "nothing"},
+		{name: "reloadable", args: []string{"-rate-limit", "10", "-fix-policy", "drop", "-log-level", "DEBUG"}, reloadable: []string{"fixPolicy", "rateLimit", "logLevel"}},
+		{name: "restart", args: []string{"-broker", "tcp://other:1883", "-workers", "4", "-listen", "tcp://0.0.0.0:9000"}, restart: []string{"broker", "listeners", "workers"}},
+		{name: "token", env: map[string]string{"GPSADAPTER_TOKEN": "rotated"}, restart: []string{"token"}},
+		{name: "both", args: []string{"-schema", "flat", "-overflow", "spill"}, reloadable: []string{"schema"}, restart: []string{"overflow"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, test.env)
+			next, err := loadConfig(test.args)
+			require.NoError(t, err)
+			var reloadable, restart []string
+			for _, s := range config.changes(next) {
+				if s.reloadable {
+					reloadable = append(reloadable, s.name)
+				} else {
+					restart = append(restart, s.name)
+				}
+			}
+			assert.Equal(t, test.reloadable, reloadable)
+			assert.Equal(t, test.restart, restart)
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	setenv(t, map[string]string{"GPSADAPTER_TOKEN": "secret"})
+	defer func(old *Config) { config = old }(config)
+	var err error
+	config, err = loadConfig(nil)
+	require.NoError(t, err)
+	config.apply()
+	defer setDeviceFilter(nil, 0)
+
+	// Reloadable settings are applied, the others are left as the adapter was started with
+	reload([]string{"-rate-limit", "1", "-broker", "tcp://other:1883"})
+	assert.Equal(t, 1, config.RateLimit)
+	assert.Equal(t, "tcp://127.0.0.1:1883", config.Broker)
+	assert.True(t, allowRecord(&gpsparser.Envelope{Device: "reload"}))
+	assert.False(t, allowRecord(&gpsparser.Envelope{Device: "reload"}))
+
+	// An invalid configuration changes nothing
+	reload([]string{"-rate-limit", "2", "-fix-policy", "guess"})
+	assert.Equal(t, 1, config.RateLimit)
+	assert.Equal(t, "flag", config.FixPolicy)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+)
+
+// Counters for records that were not sent, published through expvar so they show up in /debug/vars
+var filteredVars = struct {
+	notAllowed  expvar.Int // Records of devices missing from the allowlist
+	rateLimited expvar.Int // Records over the rate limit of their device
+}{}
+
+func init() {
+	m := expvar.NewMap("gpsadapter_filtered")
+	m.Set("notAllowed", &filteredVars.notAllowed)
+	m.Set("rateLimited", &filteredVars.rateLimited)
+}
+
+// This decides which records are sent, from the devices and rateLimit settings
+// Records are counted per device in fixed one minute windows
+// This is synchronized with Mutex as every record goes through it
+var deviceFilter = struct {
+	sync.Mutex
+	allowed   map[string]bool // nil to allow every device
+	rateLimit int             // 0 for no limit
+	window    time.Time       // When the current window started
+	counts    map[string]int  // Records sent in the current window per device
+}{counts: make(map[string]int)}
+
+// setDeviceFilter changes which devices are published and how often, it can be called while publishing
+func setDeviceFilter(devices []string, rateLimit int) {
+	var allowed map[string]bool
+	if len(devices) > 0 {
+		allowed = make(map[string]bool)
+		for _, device := range devices {
+			allowed[device] = true
+		}
+	}
+	deviceFilter.Lock()
+	deviceFilter.allowed, deviceFilter.rateLimit = allowed, rateLimit
+	deviceFilter.Unlock()
+}
+
+// allowRecord tells whether envelope may be sent now, and counts it if it may
+// Records raising an alert (SOS, emergency...) are never held back by the rate limit, they are counted all the same
+func allowRecord(envelope *gpsparser.Envelope) bool {
+	device := envelope.Device
+	deviceFilter.Lock()
+	defer deviceFilter.Unlock()
+
+	if deviceFilter.allowed != nil && !deviceFilter.allowed[device] {
+		filteredVars.notAllowed.Add(1)
+		return false
+	}
+	if deviceFilter.rateLimit == 0 {
+		return true
+	}
+
+	// Forget the previous window rather than sliding it, it also keeps counts from growing with old devices
+	if now := time.Now(); now.Sub(deviceFilter.window) >= time.Minute {
+		deviceFilter.window = now
+		deviceFilter.counts = make(map[string]int)
+	}
+	if deviceFilter.counts[device] >= deviceFilter.rateLimit && envelope.Alert == "" {
+		filteredVars.rateLimited.Add(1)
+		return false
+	}
+	deviceFilter.counts[device]++
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowRecord(t *testing.T) {
+	defer setDeviceFilter(nil, 0)
+
+	tests := []struct {
+		name      string
+		devices   []string
+		rateLimit int
+		records   []*gpsparser.Envelope
+		allowed   []bool
+	}{
+		{
+			name:    "no filter",
+			records: []*gpsparser.Envelope{{Device: "a"}, {Device: "b"}},
+			allowed: []bool{true, true},
+		},
+		{
+			name:    "allowlist",
+			devices: []string{"a"},
+			records: []*gpsparser.Envelope{{Device: "a"}, {Device: "b"}, {Device: "b", Alert: gpsparser.AlertSOS}},
+			allowed: []bool{true, false, false},
+		},
+		{
+			name:      "rate limit per device",
+			rateLimit: 2,
+			records:   []*gpsparser.Envelope{{Device: "a"}, {Device: "a"}, {Device: "b"}, {Device: "a"}},
+			allowed:   []bool{true, true, true, false},
+		},
+		{
+			name:      "alerts over the rate limit",
+			rateLimit: 1,
+			records: []*gpsparser.Envelope{
+				{Device: "a"},
+				{Device: "a", Alert: gpsparser.AlertSOS},
+				{Device: "a", Alert: gpsparser.AlertEmergency},
+				{Device: "a"},
+			},
+			allowed: []bool{true, true, true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setDeviceFilter(test.devices, test.rateLimit)
+			deviceFilter.Lock()
+			deviceFilter.window, deviceFilter.counts = time.Time{}, make(map[string]int)
+			deviceFilter.Unlock()
+
+			var allowed []bool
+			for _, envelope := range test.records {
+				allowed = append(allowed, allowRecord(envelope))
+			}
+			assert.Equal(t, test.allowed, allowed)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	mq "github.com/reisub1/go/gpsAdapter/mq"
+	spool "github.com/reisub1/go/gpsAdapter/spool"
+)
+
+// The records kept on disk while the broker cannot be reached, they are replayed in order once it is back
+// Devices in the field do not send their history again, so this is the only copy of it
+// This is synchronized with Mutex so that no record is published directly while older ones wait in the backlog
+var backlog = struct {
+	sync.Mutex
+	spool  *spool.Spool
+	drops  int  // Records dropped to make room, so replay can tell whether the record it sent is still there
+	closed bool // Set by closeBacklog, nothing is stored or replayed after that
+}{}
+
+// Wakes replay up when the broker is back or when records are added to the backlog
+var replayWake = make(chan struct{}, 1)
+
+// Counters for the backlog, published through expvar so they show up in /debug/vars
+var backlogVars = struct {
+	stored   expvar.Int // Records put in the backlog
+	replayed expvar.Int // Records sent from the backlog
+	dropped  expvar.Int // Records dropped because the backlog was full, or closed on shutdown
+}{}
+
+func init() {
+	m := expvar.NewMap("gpsadapter_backlog")
+	m.Set("online", expvar.Func(func() interface{} { return c != nil && mq.Online(c) }))
+	m.Set("records", expvar.Func(func() interface{} {
+		if backlog.spool == nil {
+			return 0
+		}
+		return backlog.spool.Len()
+	}))
+	m.Set("bytes", expvar.Func(func() interface{} {
+		if backlog.spool == nil {
+			return 0
+		}
+		return backlog.spool.Size()
+	}))
+	m.Set("stored", &backlogVars.stored)
+	m.Set("replayed", &backlogVars.replayed)
+	m.Set("dropped", &backlogVars.dropped)
+}
+
+// startForwarding opens the backlog and starts replaying it whenever the broker can be reached
+// Records left in the backlog by the last run are replayed first
+func startForwarding() error {
+	s, err := spool.Open(config.BacklogDir, config.BacklogSize)
+	if err != nil {
+		return err
+	}
+	if n := s.Len(); n > 0 {
+		log.Noticef("%d records left in the backlog %s", n, config.BacklogDir)
+	}
+	s.SetSync(time.Duration(config.SyncInterval) * time.Millisecond)
+	backlog.spool = s
+
+	publishing.Add(1)
+	go replay()
+	wakeReplay()
+	return nil
+}
+
+// brokerConnected is called by mq every time the connection to the broker comes up
+func brokerConnected() {
+	log.Noticef("Connected to the MQTT broker %s", config.Broker)
+	wakeReplay()
+}
+
+// brokerLost is called by mq every time the connection to the broker goes down, or cannot be made
+func brokerLost(err error) {
+	log.Warningf("MQTT broker %s unavailable, keeping records in the backlog: %s", config.Broker, err)
+	// The gateway session is gone along with the connection, devices have to be connected again
+	deviceStatus.Lock()
+	deviceStatus.connected = make(map[string]bool)
+	deviceStatus.Unlock()
+}
+
+func wakeReplay() {
+	select {
+	case replayWake <- struct{}{}:
+	default:
+	}
+}
+
+// store keeps envelope in the backlog
+func store(envelope *gpsparser.Envelope) {
+	backlog.Lock()
+	storeLocked(envelope)
+	backlog.Unlock()
+}
+
+// storeLocked is store for callers that hold the backlog lock
+// When the backlog is full the oldest records are dropped to make room, fresh positions are the ones that matter most
+func storeLocked(envelope *gpsparser.Envelope) {
+	if backlog.closed {
+		backlogVars.dropped.Add(1)
+		return
+	}
+	record, err := json.Marshal(envelope)
+	if err != nil {
+		queueVars.failed.Add(1)
+		log.Debugf("Record of %s not stored: %s", envelope.Device, err)
+		return
+	}
+	for {
+		err = backlog.spool.Push(record)
+		if err != spool.ErrFull || backlog.spool.Len() == 0 {
+			break
+		}
+		backlog.spool.Pop()
+		backlog.drops++
+		backlogVars.dropped.Add(1)
+	}
+	if err != nil {
+		backlogVars.dropped.Add(1)
+		log.Errorf("Backlog: %s", err)
+		return
+	}
+	backlogVars.stored.Add(1)
+	wakeReplay()
+}
+
+// replay sends the records in the backlog, oldest first, for as long as the broker can be reached
+// A record is only removed from the backlog once it has been sent, it runs until the adapter stops
+func replay() {
+	defer publishing.Done()
+	for {
+		select {
+		case <-stopping:
+			return
+		case <-replayWake:
+		}
+
+		for mq.Online(c) {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+
+			backlog.Lock()
+			if backlog.closed {
+				backlog.Unlock()
+				return
+			}
+			record, err := backlog.spool.Peek()
+			drops := backlog.drops
+			backlog.Unlock()
+			if err == spool.ErrEmpty {
+				break
+			}
+			// The damaged segment is gone, the records after it can still be replayed
+			if err == spool.ErrCorrupt {
+				backlogVars.dropped.Add(1)
+				log.Errorf("Backlog: %s", err)
+				continue
+			}
+			if err != nil {
+				log.Errorf("Backlog: %s", err)
+				break
+			}
+
+			envelope, err := unmarshalEnvelope(record)
+			if err != nil {
+				log.Errorf("Backlog: %s", err)
+			} else if err := send(envelope); err != nil {
+				log.Debugf("Backlog not replayed: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			// Unless it was dropped to make room while it was being sent, the record is still the oldest one
+			backlog.Lock()
+			if backlog.drops == drops && !backlog.closed {
+				backlog.spool.Pop()
+			}
+			backlog.Unlock()
+			backlogVars.replayed.Add(1)
+		}
+	}
+}
+
+// closeBacklog flushes the backlog to disk, the records in it are replayed after the next start
+func closeBacklog() {
+	backlog.Lock()
+	defer backlog.Unlock()
+	if backlog.closed {
+		return
+	}
+	backlog.closed = true
+	if n := backlog.spool.Len(); n > 0 {
+		log.Noticef("%d records kept in the backlog %s", n, config.BacklogDir)
+	}
+	if err := backlog.spool.Close(); err != nil {
+		log.Errorf("Backlog: %s", err)
+	}
+}
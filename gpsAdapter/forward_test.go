@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	mq "github.com/reisub1/go/gpsAdapter/mq"
+	spool "github.com/reisub1/go/gpsAdapter/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker takes MQTT connections and acknowledges every message, remembering their topics and payloads
+type fakeBroker struct {
+	sync.Mutex
+	ln       net.Listener
+	messages []string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{ln: ln}
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				p, err := packets.ReadPacket(conn)
+				if err != nil {
+					return
+				}
+				switch p := p.(type) {
+				case *packets.ConnectPacket:
+					packets.NewControlPacket(packets.Connack).Write(conn)
+				case *packets.PingreqPacket:
+					packets.NewControlPacket(packets.Pingresp).Write(conn)
+				case *packets.PublishPacket:
+					b.Lock()
+					b.messages = append(b.messages, p.TopicName+" "+string(p.Payload))
+					b.Unlock()
+					ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+					ack.MessageID = p.MessageID
+					ack.Write(conn)
+				}
+			}
+		}()
+	}
+}
+
+// received returns the messages published on topic so far
+func (b *fakeBroker) received(topic string) []string {
+	b.Lock()
+	defer b.Unlock()
+	var messages []string
+	for _, m := range b.messages {
+		if strings.HasPrefix(m, topic+" ") {
+			messages = append(messages, strings.TrimPrefix(m, topic+" "))
+		}
+	}
+	return messages
+}
+
+// openBacklog opens a backlog of at most max bytes in a fresh directory, it is closed at the end of the test
+func openBacklog(t *testing.T, max int64) {
+	dir, err := ioutil.TempDir("", "gpsAdapter")
+	require.NoError(t, err)
+	s, err := spool.Open(dir, max)
+	require.NoError(t, err)
+	backlog.spool, backlog.drops, backlog.closed = s, 0, false
+	t.Cleanup(func() {
+		backlog.spool.Close()
+		backlog.spool, backlog.drops, backlog.closed = nil, 0, false
+		os.RemoveAll(dir)
+	})
+}
+
+// backlogged returns the devices of the records in the backlog, oldest first, and empties it
+func backlogged(t *testing.T) []string {
+	var devices []string
+	for {
+		record, err := backlog.spool.Pop()
+		if err == spool.ErrEmpty {
+			return devices
+		}
+		require.NoError(t, err)
+		envelope, err := unmarshalEnvelope(record)
+		require.NoError(t, err)
+		devices = append(devices, envelope.Device)
+	}
+}
+
+func TestBacklogStore(t *testing.T) {
+	// Room for three records, they all take as many bytes
+	record, err := json.Marshal(&gpsparser.Envelope{Device: "d0"})
+	require.NoError(t, err)
+	size := int64(len(record) + 8)
+
+	tests := []struct {
+		name    string
+		max     int64
+		stored  []string
+		kept    []string
+		dropped int64
+	}{
+		{name: "in order", max: 0, stored: []string{"d0", "d1", "d2", "d3"}, kept: []string{"d0", "d1", "d2", "d3"}},
+		{name: "full", max: 3 * size, stored: []string{"d0", "d1", "d2", "d3", "d4"}, kept: []string{"d2", "d3", "d4"}, dropped: 2},
+		{name: "too small for a record", max: size - 1, stored: []string{"d0"}, dropped: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			openBacklog(t, test.max)
+			dropped := backlogVars.dropped.Value()
+			for _, device := range test.stored {
+				store(&gpsparser.Envelope{Device: device})
+			}
+			assert.Equal(t, test.kept, backlogged(t))
+			assert.Equal(t, test.dropped, backlogVars.dropped.Value()-dropped)
+		})
+	}
+
+	// Nothing is stored once the backlog is closed on shutdown
+	openBacklog(t, 0)
+	closeBacklog()
+	store(&gpsparser.Envelope{Device: "d0"})
+	assert.Equal(t, 0, backlog.spool.Len())
+}
+
+func TestBacklogReplay(t *testing.T) {
+	defer func(old *Config) { config = old }(config)
+	b := newFakeBroker(t)
+	defer b.ln.Close()
+	config = defaultConfig()
+	config.Broker = "tcp://" + b.ln.Addr().String()
+	openBacklog(t, 0)
+
+	// Records kept while the broker was away, two devices interleaved
+	for i := 1; i <= 6; i++ {
+		device := fmt.Sprintf("dev%d", i%2)
+		store(&gpsparser.Envelope{
+			Device: device,
+			Record: gpsparser.GPSParsed{Uniqid: device, TS_Millis: int64(i), ActualLat: 18.7, ActualLng: 80.1},
+		})
+	}
+
+	c = mq.Connect(config.Broker, "token", brokerConnected, brokerLost)
+	publishing.Add(1)
+	go replay()
+	defer func() {
+		(*c).Disconnect(0)
+		deviceStatus.Lock()
+		deviceStatus.connected = make(map[string]bool)
+		deviceStatus.Unlock()
+	}()
+
+	assert.Eventually(t, func() bool {
+		backlog.Lock()
+		defer backlog.Unlock()
+		return backlog.spool.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Every device is connected before its first record, and records are replayed oldest first
+	assert.Equal(t, []string{`{"device":"dev1"}`, `{"device":"dev0"}`}, b.received(gpsparser.TopicConnect))
+	var order []string
+	ts := regexp.MustCompile(`^\{"(dev\d)":\[\{"ts":(\d+),`)
+	for _, m := range b.received(gpsparser.TopicTelemetry) {
+		if match := ts.FindStringSubmatch(m); assert.NotNil(t, match, m) {
+			order = append(order, match[1]+"@"+match[2])
+		}
+	}
+	assert.Equal(t, []string{"dev1@1", "dev0@2", "dev1@3", "dev0@4", "dev1@5", "dev0@6"}, order)
+
+	// Replay stops once the backlog is closed
+	closeBacklog()
+	wakeReplay()
+	publishing.Wait()
+}
@@ -0,0 +1,357 @@
+package gpsparser
+
+import (
+	"bytes"
+	"math"
+)
+
+// AIS140 is the CSV based protocol used by AIS140 certified trackers, every message
+// starts with "GTPL $<packet type>" and multiple messages are delimited by #
+type ais140 struct{}
+
+func init() {
+	Register(ais140{})
+}
+
+func (ais140) Name() string {
+	return "AIS140"
+}
+
+func (ais140) Detect(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte("GTPL"))
+}
+
+func (ais140) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	// This format can have multiple messages delimited by #
+	return parseFrames(s, records, errs, raw, '#', parseAIS140)
+}
+
+// The telemetry of the status ($1), alert ($4, $7), emergency ($EPB) and health ($HLM) packets
+var (
+	ais140StatusFields = []field{fieldSpeed, fieldOdo, fieldDir, fieldSats, fieldBox, fieldGSM, fieldBat, fieldIgn, fieldVolt}
+	ais140AlertFields  = []field{fieldBatLow}
+	ais140SpeedFields  = []field{fieldSpeed}
+	ais140HealthFields = []field{fieldBatPct, fieldBatLow, fieldMemPct, fieldDIO, fieldAIO}
+)
+
+func (ais140) telemetry(g *GPSParsed) []field {
+	switch g.PacketType {
+	case "$1":
+		return ais140StatusFields
+	case "$4":
+		return ais140AlertFields
+	case "$7", "$EPB":
+		return ais140SpeedFields
+	case "$HLM":
+		return ais140HealthFields
+	}
+	return nil
+}
+
+// parseAIS140 parses a single AIS140 message (without the trailing #) into g
+// Every message carries the device ID, so the session is not needed
+func parseAIS140(_ *Session, g *GPSParsed, message []byte) error {
+	g.Raw = message
+	g.Protocol = "AIS140"
+
+	var buf [24][]byte
+	fields := splitFields(buf[:0], message)
+	if len(fields) == 1 {
+		return messageError(g, string(message), ReasonNotCSV)
+	}
+
+	// 0th field has GTPL $1, GTPL $2 etc for different types of packets
+	header := fields[0]
+	if !bytes.HasPrefix(header, []byte("GTPL ")) || len(header) < 6 {
+		return fieldError(g, 0, string(header), ReasonBadHeader)
+	}
+	g.PacketType = ais140PacketType(header[5:])
+	g.Uniqid = internID(fields[1])
+
+	// Login, health and emergency packets have their own layouts
+	switch g.PacketType {
+	case "$LGN":
+		return parseAIS140Login(g, fields)
+	case "$HLM":
+		return parseAIS140Health(g, fields)
+	case "$EPB":
+		return parseAIS140Emergency(g, fields)
+	}
+
+	switch len(fields) {
+	case 10:
+		break
+	case 18:
+		break
+	default:
+		return messageError(g, string(message), ReasonFieldCount)
+	}
+
+	// For any packet type we have the following fields Uniqid, Fix validity, TimeDate, Lat, Long
+	var err error
+	if g.InvalidFix, err = fixField(g, fields, 2); err != nil {
+		return err
+	}
+	if g.TS_Millis, err = timeField(g, fields, 3, 4); err != nil {
+		return err
+	}
+	if err = aisPosition(g, fields, 5); err != nil {
+		return err
+	}
+
+	// Now each packetType has its own specific parameters and syntax
+	switch g.PacketType {
+	// Status packet ($1)
+	case "$1":
+		if len(fields) != 18 {
+			return messageError(g, string(message), ReasonFieldCount)
+		}
+		// 9th to 12th fields are speed (km/h), odometer, heading (degrees) and number of satellites
+		if g.Speed, err = intField(g, fields, 9, 0, 300); err != nil {
+			return err
+		}
+		if g.OdoMeter, err = intField(g, fields, 10, 0, math.MaxInt32); err != nil {
+			return err
+		}
+		if g.Direction, err = intField(g, fields, 11, 0, 360); err != nil {
+			return err
+		}
+		if g.NoOfSatellites, err = intField(g, fields, 12, 0, 99); err != nil {
+			return err
+		}
+		if g.StatusBox, err = boolField(g, fields, 13); err != nil {
+			return err
+		}
+		// 14th field is the GSM signal strength as reported by AT+CSQ (0-31), or 99 when it is not known yet
+		if string(fields[14]) == "99" {
+			g.GSMSignal = -1
+		} else if g.GSMSignal, err = intField(g, fields, 14, 0, 31); err != nil {
+			return err
+		}
+		if g.StatusBattery, err = boolField(g, fields, 15); err != nil {
+			return err
+		}
+		if g.StatusIgnition, err = boolField(g, fields, 16); err != nil {
+			return err
+		}
+		// 17th field is the analog supply voltage
+		if g.Voltage, err = floatField(g, fields, 17, 0, 100); err != nil {
+			return err
+		}
+	// Ignition Alert packet ($2)
+	case "$2":
+		if g.StatusIgnition, err = boolField(g, fields, 9); err != nil {
+			return err
+		}
+		if g.StatusIgnition {
+			g.Alert = AlertIgnitionOn
+		} else {
+			g.Alert = AlertIgnitionOff
+		}
+	// Main Battery Alert packet ($3)
+	case "$3":
+		if g.StatusBattery, err = boolField(g, fields, 9); err != nil {
+			return err
+		}
+		if g.StatusBattery {
+			g.Alert = AlertBatteryConnected
+		} else {
+			g.Alert = AlertBatteryDisconnected
+		}
+	// Low Battery Alert packet ($4)
+	case "$4":
+		g.BatteryLow = true
+		g.Alert = AlertBatteryLow
+	// Harsh Acceleration Alert packet ($5)
+	case "$5":
+		g.Alert = AlertHarshAcceleration
+	// Harsh Braking Alert packet ($6)
+	case "$6":
+		g.Alert = AlertHarshBraking
+	// Overspeeding Alert packet ($7)
+	case "$7":
+		g.Alert = AlertOverSpeed
+		if g.Speed, err = intField(g, fields, 9, 0, 300); err != nil {
+			return err
+		}
+	// Box Alert packet ($8)
+	case "$8":
+		if g.StatusBox, err = boolField(g, fields, 9); err != nil {
+			return err
+		}
+		if g.StatusBox {
+			g.Alert = AlertBoxOpened
+		} else {
+			g.Alert = AlertBoxClosed
+		}
+	// SOS Alert packet ($9)
+	case "$9":
+		g.Alert = AlertSOS
+	default:
+		return fieldError(g, 0, string(fields[0]), ReasonUnknownPacket)
+	}
+
+	return nil
+}
+
+// aisPosition fills in the position from the lat, N/S, lng, E/W fields starting at field i
+func aisPosition(g *GPSParsed, fields [][]byte, i int) error {
+	var err error
+	// 1st field contains latitude as a float, 2nd its direction
+	if g.ActualLat, err = floatField(g, fields, i, 0, 90); err != nil {
+		return err
+	}
+	switch string(fields[i+1]) {
+	case "N":
+	case "S":
+		g.ActualLat = -g.ActualLat
+	default:
+		return fieldError(g, i+1, string(fields[i+1]), ReasonBadHemisphere)
+	}
+
+	// 3rd field contains longitude as a float, 4th its direction
+	if g.ActualLng, err = floatField(g, fields, i+2, 0, 180); err != nil {
+		return err
+	}
+	switch string(fields[i+3]) {
+	case "E":
+	case "W":
+		g.ActualLng = -g.ActualLng
+	default:
+		return fieldError(g, i+3, string(fields[i+3]), ReasonBadHemisphere)
+	}
+	return nil
+}
+
+// parseAIS140Login parses a login packet, sent once by the device after it connects
+// GTPL $LGN,imei,ddmmyy,hhmmss,vehicle registration,firmware version,protocol version
+// Everything in it is published as device attributes
+func parseAIS140Login(g *GPSParsed, fields [][]byte) error {
+	if len(fields) != 7 {
+		return messageError(g, string(g.Raw), ReasonFieldCount)
+	}
+	var err error
+	if g.TS_Millis, err = timeField(g, fields, 2, 3); err != nil {
+		return err
+	}
+	g.NoPosition = true
+	g.Attributes = map[string]string{
+		"vehicle":         string(fields[4]),
+		"firmware":        string(fields[5]),
+		"protocolVersion": string(fields[6]),
+	}
+	return nil
+}
+
+// parseAIS140Health parses a periodic health monitoring packet
+// GTPL $HLM,imei,ddmmyy,hhmmss,firmware version,battery %,low battery threshold %,memory %,
+// update rate with ignition on (s),update rate with ignition off (s),digital IO,analog IO
+// The firmware and update rates are device attributes, the rest is telemetry
+func parseAIS140Health(g *GPSParsed, fields [][]byte) error {
+	if len(fields) != 12 {
+		return messageError(g, string(g.Raw), ReasonFieldCount)
+	}
+	var err error
+	if g.TS_Millis, err = timeField(g, fields, 2, 3); err != nil {
+		return err
+	}
+	g.NoPosition = true
+
+	if g.BatteryPercent, err = intField(g, fields, 5, 0, 100); err != nil {
+		return err
+	}
+	lowBattery, err := intField(g, fields, 6, 0, 100)
+	if err != nil {
+		return err
+	}
+	g.BatteryLow = g.BatteryPercent < lowBattery
+	if g.MemoryPercent, err = intField(g, fields, 7, 0, 100); err != nil {
+		return err
+	}
+	if _, err = intField(g, fields, 8, 0, math.MaxInt32); err != nil {
+		return err
+	}
+	if _, err = intField(g, fields, 9, 0, math.MaxInt32); err != nil {
+		return err
+	}
+
+	// IO states are sent as strings of 0s and 1s, one per pin
+	for i := 10; i < 12; i++ {
+		if len(bytes.Trim(fields[i], "01")) != 0 {
+			return fieldError(g, i, string(fields[i]), ReasonBadValue)
+		}
+	}
+	g.DigitalIO = string(fields[10])
+	g.AnalogIO = string(fields[11])
+
+	g.Attributes = map[string]string{
+		"firmware":         string(fields[4]),
+		"updateRateIgnOn":  string(fields[8]),
+		"updateRateIgnOff": string(fields[9]),
+	}
+	return nil
+}
+
+// parseAIS140Emergency parses an emergency (panic button) packet
+// GTPL $EPB,imei,A,ddmmyy,hhmmss,lat,N,lng,E,speed,EMR or SEM
+// EMR is sent while the emergency is on, SEM once it has been stopped
+func parseAIS140Emergency(g *GPSParsed, fields [][]byte) error {
+	if len(fields) != 11 {
+		return messageError(g, string(g.Raw), ReasonFieldCount)
+	}
+	var err error
+	if g.InvalidFix, err = fixField(g, fields, 2); err != nil {
+		return err
+	}
+	if g.TS_Millis, err = timeField(g, fields, 3, 4); err != nil {
+		return err
+	}
+	if err = aisPosition(g, fields, 5); err != nil {
+		return err
+	}
+	if g.Speed, err = intField(g, fields, 9, 0, 300); err != nil {
+		return err
+	}
+
+	switch string(fields[10]) {
+	case "EMR":
+		g.Alert = AlertEmergency
+	case "SEM":
+		g.Alert = AlertEmergencyStopped
+	default:
+		return fieldError(g, 10, string(fields[10]), ReasonBadValue)
+	}
+	return nil
+}
+
+// ais140PacketType returns the packet type as one of the constant strings, so known packet types do not allocate
+// and unknown ones are all the same
+func ais140PacketType(b []byte) string {
+	switch string(b) {
+	case "$1":
+		return "$1"
+	case "$2":
+		return "$2"
+	case "$3":
+		return "$3"
+	case "$4":
+		return "$4"
+	case "$5":
+		return "$5"
+	case "$6":
+		return "$6"
+	case "$7":
+		return "$7"
+	case "$8":
+		return "$8"
+	case "$9":
+		return "$9"
+	case "$LGN":
+		return "$LGN"
+	case "$HLM":
+		return "$HLM"
+	case "$EPB":
+		return "$EPB"
+	}
+	return unknownPacketType
+}
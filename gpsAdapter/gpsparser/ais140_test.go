@@ -0,0 +1,75 @@
+package gpsparser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAIS140Login(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("GTPL $LGN,867322035135813,290518,062804,KA01AB1234,1.2.3,1.0#"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("$LGN", g.PacketType)
+		assert.True(g.NoPosition)
+		assert.Equal(map[string]string{"vehicle": "KA01AB1234", "firmware": "1.2.3", "protocolVersion": "1.0"}, g.Attributes)
+		assert.Equal(`{"867322035135813":{"firmware":"1.2.3","protocolVersion":"1.0","vehicle":"KA01AB1234"}}`, encode(ThingsBoard{}.AppendAttributes(nil, &g)))
+		assert.Empty(encode(ThingsBoard{}.AppendTelemetry(nil, &g)))
+	}
+}
+
+func TestParseAIS140Health(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("GTPL $HLM,867322035135813,290518,062804,1.2.3,15,20,45,10,60,0101,00#"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal(15, g.BatteryPercent)
+		assert.True(g.BatteryLow)
+		assert.Equal(45, g.MemoryPercent)
+		assert.Equal("0101", g.DigitalIO)
+		assert.Equal("00", g.AnalogIO)
+		assert.Equal(`{"867322035135813":{"firmware":"1.2.3","updateRateIgnOff":"60","updateRateIgnOn":"10"}}`, encode(ThingsBoard{}.AppendAttributes(nil, &g)))
+		assert.Equal(`{"867322035135813":[{"ts":1527575284000,"values":{"batPct":15,"batLow":true,"memPct":45,"dio":"0101","aio":"00"}}]}`, encode(ThingsBoard{}.AppendTelemetry(nil, &g)))
+	}
+
+	// Percentages over 100 and garbage IO states are rejected
+	_, errs = ParseMessages([]byte("GTPL $HLM,867322035135813,290518,062804,1.2.3,101,20,45,10,60,0101,00#GTPL $HLM,867322035135813,290518,062804,1.2.3,80,20,45,10,60,0121,00#"))
+	assert.Len(errs, 2)
+}
+
+func TestParseAIS140Emergency(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("GTPL $EPB,867322035135813,A,290518,062804,18.709738,N,80.068397,E,42,EMR#GTPL $EPB,867322035135813,A,290518,062904,18.709738,N,80.068397,E,0,SEM#"))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		assert.Equal(AlertEmergency, records[0].Alert)
+		assert.Equal(42, records[0].Speed)
+		assert.Equal(AlertEmergencyStopped, records[1].Alert)
+	}
+
+	// Both the login attributes and emergency telemetry reach the channel, and are published on their own topics
+	c := make(chan *Envelope, 10)
+	raw := "GTPL $LGN,867322035135813,290518,062804,KA01AB1234,1.2.3,1.0#GTPL $EPB,867322035135813,A,290518,062804,18.709738,N,80.068397,E,42,EMR#"
+	Parse(&raw, c)
+	for _, topic := range []string{TopicAttributes, TopicTelemetry} {
+		select {
+		case output := <-c:
+			assert.Equal("867322035135813", output.Device)
+			assert.Equal("AIS140", output.Protocol)
+			publications, err := output.Publications()
+			assert.NoError(err)
+			if assert.Len(publications, 1) {
+				assert.Equal(topic, publications[0].Topic)
+			}
+		case <-time.After(time.Millisecond):
+			assert.Fail("missing publication on " + topic)
+		}
+	}
+}
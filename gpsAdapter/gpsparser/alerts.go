@@ -0,0 +1,45 @@
+package gpsparser
+
+import (
+	"sync"
+)
+
+// AlertRules raise and silence alerts on top of what the devices report themselves
+type AlertRules struct {
+	// Raise AlertOverSpeed for positions faster than this many km/h, 0 to leave overspeeding to the devices
+	OverSpeed int `json:"overSpeed"`
+	// Alerts that are not published, the rest of the packet still is
+	Mute []string `json:"mute"`
+}
+
+// The current alert rules, with the muted alerts as a set
+var alertRules = struct {
+	sync.RWMutex
+	overSpeed int
+	mute      map[string]bool
+}{}
+
+// SetAlertRules changes the rules applied to packets parsed from now on, by default there are none
+func SetAlertRules(rules AlertRules) {
+	mute := make(map[string]bool)
+	for _, alert := range rules.Mute {
+		mute[alert] = true
+	}
+	alertRules.Lock()
+	alertRules.overSpeed, alertRules.mute = rules.OverSpeed, mute
+	alertRules.Unlock()
+}
+
+// applyAlertRules raises and mutes the alert of g according to the current rules
+// Alerts sent by the device win over the ones raised here
+func applyAlertRules(g *GPSParsed) {
+	alertRules.RLock()
+	defer alertRules.RUnlock()
+
+	if g.Alert == "" && alertRules.overSpeed > 0 && !g.NoPosition && g.Speed > alertRules.overSpeed {
+		g.Alert = AlertOverSpeed
+	}
+	if alertRules.mute[g.Alert] {
+		g.Alert = ""
+	}
+}
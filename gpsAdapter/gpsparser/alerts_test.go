@@ -0,0 +1,31 @@
+package gpsparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertRules(t *testing.T) {
+	assert := assert.New(t)
+	defer SetAlertRules(AlertRules{})
+
+	messages := []byte("GTPL $1,1001,A,290518,062804,18.709738,N,80.068397,E,95,406,309,11,0,14,1,0,26.4470#" +
+		"GTPL $1,1001,A,290518,062805,18.709738,N,80.068397,E,75,406,309,11,0,14,1,0,26.4470#" +
+		"GTPL $9,1001,A,290518,062806,18.709738,N,80.068397,E,0#")
+
+	// No rules, only what the devices say
+	records, _ := ParseMessages(messages)
+	if assert.Len(records, 3) {
+		assert.Empty(records[0].Alert)
+		assert.Equal(AlertSOS, records[2].Alert)
+	}
+
+	SetAlertRules(AlertRules{OverSpeed: 80, Mute: []string{AlertSOS}})
+	records, _ = ParseMessages(messages)
+	if assert.Len(records, 3) {
+		assert.Equal(AlertOverSpeed, records[0].Alert)
+		assert.Empty(records[1].Alert)
+		assert.Empty(records[2].Alert)
+	}
+}
@@ -0,0 +1,451 @@
+package gpsparser
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Encoder serializes parsed records for whoever consumes them downstream
+// Encoders append to a buffer supplied by the caller, so buffers can be reused between records
+type Encoder interface {
+	// AppendTelemetry appends the encoded telemetry of g to dst, dst is returned unchanged if g has none
+	AppendTelemetry(dst []byte, g *GPSParsed) ([]byte, error)
+	// AppendAttributes appends the encoded device attributes of g to dst, dst is returned unchanged if g has none
+	AppendAttributes(dst []byte, g *GPSParsed) ([]byte, error)
+	// Topics returns the topics the telemetry and the attributes are published on
+	// gateway tells that they are the Gateway API ones, devices then have to be connected before their data is published
+	Topics() (telemetry, attributes string, gateway bool)
+}
+
+// Keys renames telemetry and attribute keys on output, e.g. {"lat": "latitude"}
+// Keys that are not in the map are written as they are
+type Keys map[string]string
+
+func (k Keys) name(key string) string {
+	if renamed, ok := k[key]; ok {
+		return renamed
+	}
+	return key
+}
+
+// ThingsBoard encodes records for the ThingsBoard MQTT Gateway API
+// {"device":[{"ts":1527575284000,"values":{"lat":18.709738,...}}]} and {"device":{"firmware":"1.2.3"}}
+type ThingsBoard struct {
+	Keys Keys
+}
+
+func (e ThingsBoard) Topics() (telemetry, attributes string, gateway bool) {
+	return TopicTelemetry, TopicAttributes, true
+}
+
+func (e ThingsBoard) AppendTelemetry(dst []byte, g *GPSParsed) ([]byte, error) {
+	var buf [maxValues]value
+	values := telemetryValues(buf[:0], g, true)
+	if len(values) == 0 {
+		return dst, nil
+	}
+	b := append(dst, '{')
+	b = appendString(b, g.Uniqid)
+	b = append(b, `:[{"ts":`...)
+	b = strconv.AppendInt(b, g.TS_Millis, 10)
+	b = append(b, `,"values":`...)
+	b, err := appendObject(b, values, e.Keys)
+	if err != nil {
+		return dst, encodeError(g, err)
+	}
+	return append(b, "}]}"...), nil
+}
+
+func (e ThingsBoard) AppendAttributes(dst []byte, g *GPSParsed) ([]byte, error) {
+	if len(g.Attributes) == 0 {
+		return dst, nil
+	}
+	b := append(dst, '{')
+	b = appendString(b, g.Uniqid)
+	b = append(b, ':')
+	b, _ = appendObject(b, attributeValues(nil, g), e.Keys)
+	return append(b, '}'), nil
+}
+
+// ThingsBoardDevice encodes the {"device":"..."} payload of the Gateway API connect and disconnect topics
+func ThingsBoardDevice(device string) []byte {
+	b := []byte(`{"device":`)
+	b = appendString(b, device)
+	return append(b, '}')
+}
+
+// Flat encodes every record as a single flat JSON object
+// {"device":"...","ts":1527575284000,"lat":18.709738,...}
+// It is published on Topic/telemetry and Topic/attributes, the Gateway API would take every key for a device
+type Flat struct {
+	Keys  Keys
+	Topic string
+}
+
+func (e Flat) Topics() (telemetry, attributes string, gateway bool) {
+	return e.Topic + "/telemetry", e.Topic + "/attributes", false
+}
+
+func (e Flat) AppendTelemetry(dst []byte, g *GPSParsed) ([]byte, error) {
+	var buf [maxValues]value
+	values := telemetryValues(append(buf[:0], text("device", g.Uniqid), number("ts", g.TS_Millis)), g, true)
+	if len(values) == 2 {
+		return dst, nil
+	}
+	b, err := appendObject(dst, values, e.Keys)
+	if err != nil {
+		return dst, encodeError(g, err)
+	}
+	return b, nil
+}
+
+func (e Flat) AppendAttributes(dst []byte, g *GPSParsed) ([]byte, error) {
+	if len(g.Attributes) == 0 {
+		return dst, nil
+	}
+	b, _ := appendObject(dst, attributeValues([]value{text("device", g.Uniqid)}, g), e.Keys)
+	return b, nil
+}
+
+// GeoJSON encodes every record as a GeoJSON Feature with a Point geometry
+// Everything else goes into its properties, records without a position have a null geometry
+// It is published on Topic/telemetry and Topic/attributes, like Flat
+type GeoJSON struct {
+	Keys  Keys
+	Topic string
+}
+
+func (e GeoJSON) Topics() (telemetry, attributes string, gateway bool) {
+	return e.Topic + "/telemetry", e.Topic + "/attributes", false
+}
+
+func (e GeoJSON) AppendTelemetry(dst []byte, g *GPSParsed) ([]byte, error) {
+	// The position goes into the geometry instead of the properties
+	var buf [maxValues]value
+	properties := telemetryValues(append(buf[:0], text("device", g.Uniqid), number("ts", g.TS_Millis)), g, false)
+	if len(properties) == 2 && g.NoPosition {
+		return dst, nil
+	}
+
+	b := append(dst, `{"type":"Feature","geometry":`...)
+	if g.NoPosition {
+		b = append(b, "null"...)
+	} else {
+		if !finite(g.ActualLat) || !finite(g.ActualLng) {
+			return dst, encodeError(g, fmt.Errorf("position is not a finite number"))
+		}
+		// GeoJSON positions are longitude first
+		b = append(b, `{"type":"Point","coordinates":[`...)
+		b = strconv.AppendFloat(b, g.ActualLng, 'f', -1, 64)
+		b = append(b, ',')
+		b = strconv.AppendFloat(b, g.ActualLat, 'f', -1, 64)
+		b = append(b, "]}"...)
+	}
+	b = append(b, `,"properties":`...)
+	b, err := appendObject(b, properties, e.Keys)
+	if err != nil {
+		return dst, encodeError(g, err)
+	}
+	return append(b, '}'), nil
+}
+
+func (e GeoJSON) AppendAttributes(dst []byte, g *GPSParsed) ([]byte, error) {
+	if len(g.Attributes) == 0 {
+		return dst, nil
+	}
+	b := append(dst, `{"type":"Feature","geometry":null,"properties":`...)
+	b, _ = appendObject(b, attributeValues([]value{text("device", g.Uniqid)}, g), e.Keys)
+	return append(b, '}'), nil
+}
+
+// NewEncoder returns the encoder for the named output schema (thingsboard, flat or geojson)
+// topic is where flat and geojson records are published, ThingsBoard records always go to the Gateway API
+func NewEncoder(schema string, keys Keys, topic string) (Encoder, error) {
+	if schema != "thingsboard" && topic == "" {
+		return nil, fmt.Errorf("no topic for the %s output schema", schema)
+	}
+	switch schema {
+	case "thingsboard":
+		return ThingsBoard{Keys: keys}, nil
+	case "flat":
+		return Flat{Keys: keys, Topic: topic}, nil
+	case "geojson":
+		return GeoJSON{Keys: keys, Topic: topic}, nil
+	}
+	return nil, fmt.Errorf("unknown output schema %q", schema)
+}
+
+// The encoder used by Envelope.Publications
+var encoder = struct {
+	sync.RWMutex
+	Encoder
+}{Encoder: ThingsBoard{}}
+
+// SetEncoder changes the encoder used by Envelope.Publications, the default is ThingsBoard without any renamed keys
+func SetEncoder(e Encoder) {
+	encoder.Lock()
+	encoder.Encoder = e
+	encoder.Unlock()
+}
+
+func currentEncoder() Encoder {
+	encoder.RLock()
+	defer encoder.RUnlock()
+	return encoder.Encoder
+}
+
+// Publications encodes the record of e with the encoder set by SetEncoder, into what is published on the encoder's topics
+// Attributes come before telemetry, and a topic the record has nothing for gets no publication
+// Publications that could be encoded are returned even when the other one failed
+func (e *Envelope) Publications() ([]Publication, error) {
+	var publications []Publication
+	encoder := currentEncoder()
+	telemetryTopic, attributesTopic, gateway := encoder.Topics()
+	attributes, err := encoder.AppendAttributes(nil, &e.Record)
+	if len(attributes) > 0 && err == nil {
+		publications = append(publications, Publication{Device: e.Device, Topic: attributesTopic, Gateway: gateway, Payload: string(attributes)})
+	}
+	telemetry, terr := encoder.AppendTelemetry(attributes[:0], &e.Record)
+	if len(telemetry) > 0 && terr == nil {
+		publications = append(publications, Publication{Device: e.Device, Topic: telemetryTopic, Gateway: gateway, Payload: string(telemetry)})
+	}
+	if err == nil {
+		err = terr
+	}
+	return publications, err
+}
+
+// The most values a single record can have, enough for the biggest packet type
+const maxValues = 24
+
+// The types of value that can be published
+const (
+	kindNumber = iota
+	kindFloat
+	kindBool
+	kindString
+)
+
+// A single telemetry or attribute key and its value
+// Values are not stored in an interface{} so that building them does not allocate
+type value struct {
+	key  string
+	kind int
+	n    int64
+	f    float64
+	s    string
+}
+
+func number(key string, n int64) value  { return value{key: key, kind: kindNumber, n: n} }
+func float(key string, f float64) value { return value{key: key, kind: kindFloat, f: f} }
+func text(key string, s string) value   { return value{key: key, kind: kindString, s: s} }
+func boolean(key string, b bool) value {
+	if b {
+		return value{key: key, kind: kindBool, n: 1}
+	}
+	return value{key: key, kind: kindBool}
+}
+
+// telemetryValues appends the telemetry of g to values, in the order it is published
+// The position is left out unless withPosition is set
+func telemetryValues(values []value, g *GPSParsed, withPosition bool) []value {
+	// Add the position if this packet has one
+	if withPosition && !g.NoPosition {
+		values = append(values, float("lat", g.ActualLat), float("lng", g.ActualLng))
+	}
+
+	// Positions from an invalid fix are flagged, whatever the fix policy did to them
+	if g.InvalidFix {
+		values = append(values, boolean("valid", false))
+	}
+
+	// Alert packets carry the alert text before anything else
+	if g.Alert != "" {
+		values = append(values, text("alert", g.Alert))
+	}
+
+	// Then the telemetry the protocol of g has for its packet type
+	if t, ok := Lookup(g.Protocol).(telemeter); ok {
+		values = fieldValues(values, g, t.telemetry(g))
+	}
+	return values
+}
+
+// The telemetry keys a record can have besides the position, the fix validity and the alert
+type field int
+
+const (
+	fieldSpeed field = iota
+	fieldDir
+	fieldOdo
+	fieldSats
+	fieldFix
+	fieldAlt
+	fieldGSM
+	fieldBox
+	fieldBat
+	fieldBatLow
+	fieldBatPct
+	fieldIgn
+	fieldVolt
+	fieldMemPct
+	fieldDIO
+	fieldAIO
+	fieldIO // Every key of g.IO, sorted
+)
+
+// fieldValues appends the values of g for fields to values, in the order of fields
+func fieldValues(values []value, g *GPSParsed, fields []field) []value {
+	for _, f := range fields {
+		switch f {
+		case fieldSpeed:
+			values = append(values, number("speed", int64(g.Speed)))
+		case fieldDir:
+			values = append(values, number("dir", int64(g.Direction)))
+		case fieldOdo:
+			values = append(values, number("odo", int64(g.OdoMeter)))
+		case fieldSats:
+			values = append(values, number("sats", int64(g.NoOfSatellites)))
+		case fieldFix:
+			values = append(values, number("fix", int64(g.FixQuality)))
+		case fieldAlt:
+			values = append(values, float("alt", g.Altitude))
+		case fieldGSM:
+			// An unknown signal is left out rather than published as a strength
+			if g.GSMSignal >= 0 {
+				values = append(values, number("gsm", int64(g.GSMSignal)))
+			}
+		case fieldBox:
+			values = append(values, boolean("box", g.StatusBox))
+		case fieldBat:
+			values = append(values, boolean("bat", g.StatusBattery))
+		case fieldBatLow:
+			values = append(values, boolean("batLow", g.BatteryLow))
+		case fieldBatPct:
+			values = append(values, number("batPct", int64(g.BatteryPercent)))
+		case fieldIgn:
+			values = append(values, boolean("ign", g.StatusIgnition))
+		case fieldVolt:
+			values = append(values, float("volt", g.Voltage))
+		case fieldMemPct:
+			values = append(values, number("memPct", int64(g.MemoryPercent)))
+		case fieldDIO:
+			values = append(values, text("dio", g.DigitalIO))
+		case fieldAIO:
+			values = append(values, text("aio", g.AnalogIO))
+		case fieldIO:
+			values = ioValues(values, g)
+		}
+	}
+	return values
+}
+
+// attributeValues appends the attributes of g to values sorted by key, so the output is stable
+func attributeValues(values []value, g *GPSParsed) []value {
+	keys := make([]string, 0, len(g.Attributes))
+	for k := range g.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values = append(values, text(k, g.Attributes[k]))
+	}
+	return values
+}
+
+// ioValues appends the extra values (g.IO) of g to values sorted by key, so the output is stable
+func ioValues(values []value, g *GPSParsed) []value {
+	keys := make([]string, 0, len(g.IO))
+	for k := range g.IO {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch v := g.IO[k].(type) {
+		case int64:
+			values = append(values, number(k, v))
+		case float64:
+			values = append(values, float(k, v))
+		case string:
+			values = append(values, text(k, v))
+		}
+	}
+	return values
+}
+
+// appendObject appends values to b as a JSON object, renaming keys with keys
+func appendObject(b []byte, values []value, keys Keys) ([]byte, error) {
+	b = append(b, '{')
+	for i, v := range values {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendString(b, keys.name(v.key))
+		b = append(b, ':')
+		switch v.kind {
+		case kindNumber:
+			b = strconv.AppendInt(b, v.n, 10)
+		case kindFloat:
+			if !finite(v.f) {
+				return nil, fmt.Errorf("%s is not a finite number", v.key)
+			}
+			b = strconv.AppendFloat(b, v.f, 'f', -1, 64)
+		case kindBool:
+			b = strconv.AppendBool(b, v.n != 0)
+		case kindString:
+			b = appendString(b, v.s)
+		}
+	}
+	return append(b, '}'), nil
+}
+
+// appendString appends s to b as a JSON string, escaping whatever needs to be escaped
+// Invalid UTF-8 is replaced with U+FFFD like encoding/json does
+func appendString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, '\\', 'n')
+			case c == '\r':
+				b = append(b, '\\', 'r')
+			case c == '\t':
+				b = append(b, '\\', 't')
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, `\ufffd`...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// encodeError wraps an encoding failure with the record it happened on
+func encodeError(g *GPSParsed, err error) error {
+	return fmt.Errorf("%s %s: cannot encode record of %q: %s", g.Protocol, g.PacketType, g.Uniqid, err)
+}
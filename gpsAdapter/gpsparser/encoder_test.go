@@ -0,0 +1,91 @@
+package gpsparser
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode turns the result of an Encoder call into a string, failing on errors
+func encode(b []byte, err error) string {
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestEncoders(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("GTPL $7,867322035135813,A,290518,062804,18.709738,S,80.068397,W,92#GTPL $LGN,867322035135813,290518,062804,KA01AB1234,1.2.3,1.0#"))
+	assert.Empty(errs)
+	if !assert.Len(records, 2) {
+		return
+	}
+	status, login := &records[0], &records[1]
+
+	assert.Equal(`{"867322035135813":[{"ts":1527575284000,"values":{"lat":-18.709738,"lng":-80.068397,"alert":"OverSpeeding Alert","speed":92}}]}`,
+		encode(ThingsBoard{}.AppendTelemetry(nil, status)))
+	assert.Equal(`{"867322035135813":[{"ts":1527575284000,"values":{"latitude":-18.709738,"longitude":-80.068397,"alert":"OverSpeeding Alert","kmph":92}}]}`,
+		encode(ThingsBoard{Keys: Keys{"lat": "latitude", "lng": "longitude", "speed": "kmph"}}.AppendTelemetry(nil, status)))
+
+	assert.Equal(`{"device":"867322035135813","ts":1527575284000,"lat":-18.709738,"lng":-80.068397,"alert":"OverSpeeding Alert","speed":92}`,
+		encode(Flat{}.AppendTelemetry(nil, status)))
+	assert.Equal(`{"device":"867322035135813","firmware":"1.2.3","protocolVersion":"1.0","vehicle":"KA01AB1234"}`,
+		encode(Flat{}.AppendAttributes(nil, login)))
+	assert.Empty(encode(Flat{}.AppendTelemetry(nil, login)))
+
+	assert.Equal(`{"type":"Feature","geometry":{"type":"Point","coordinates":[-80.068397,-18.709738]},"properties":{"device":"867322035135813","ts":1527575284000,"alert":"OverSpeeding Alert","speed":92}}`,
+		encode(GeoJSON{}.AppendTelemetry(nil, status)))
+	assert.Equal(`{"type":"Feature","geometry":null,"properties":{"device":"867322035135813","firmware":"1.2.3","protocolVersion":"1.0","vehicle":"KA01AB1234"}}`,
+		encode(GeoJSON{}.AppendAttributes(nil, login)))
+	assert.Empty(encode(ThingsBoard{}.AppendAttributes(nil, status)))
+
+	_, err := NewEncoder("xml", nil, "gps")
+	assert.Error(err)
+	_, err = NewEncoder("flat", nil, "")
+	assert.Error(err)
+	e, err := NewEncoder("flat", Keys{"device": "id"}, "gps")
+	assert.NoError(err)
+	assert.Contains(encode(e.AppendTelemetry(nil, status)), `"id":"867322035135813"`)
+
+	// The telemetry comes from the protocol of the record, ZJ and H02 both call their positions V1
+	zj := &GPSParsed{Protocol: "ZJ", PacketType: "V1", Uniqid: "1", NoPosition: true, Speed: 5, StatusIgnition: true}
+	h02 := &GPSParsed{Protocol: "H02", PacketType: "V1", Uniqid: "1", NoPosition: true, Speed: 5, StatusIgnition: true}
+	assert.Equal(`{"device":"1","ts":0,"speed":5,"dir":0}`, encode(Flat{}.AppendTelemetry(nil, zj)))
+	assert.Equal(`{"device":"1","ts":0,"speed":5,"dir":0,"ign":true}`, encode(Flat{}.AppendTelemetry(nil, h02)))
+
+	// Only ThingsBoard records go to the Gateway API, which would take every key of a flat record for a device
+	publications, err := (&Envelope{Device: "1", Record: *h02}).Publications()
+	assert.NoError(err)
+	if assert.Len(publications, 1) {
+		assert.Equal(TopicTelemetry, publications[0].Topic)
+		assert.True(publications[0].Gateway)
+	}
+	defer SetEncoder(currentEncoder())
+	SetEncoder(e)
+	publications, err = (&Envelope{Device: "1", Record: *h02}).Publications()
+	assert.NoError(err)
+	if assert.Len(publications, 1) {
+		assert.Equal("gps/telemetry", publications[0].Topic)
+		assert.False(publications[0].Gateway)
+	}
+}
+
+func TestEncoderEscaping(t *testing.T) {
+	assert := assert.New(t)
+
+	// Device IDs and attributes come straight from the device, they must not be able to break the JSON
+	g := &GPSParsed{Uniqid: "evil\"}],\"x\":[{\"\n\x01\xff", PacketType: "$LGN", NoPosition: true, Attributes: map[string]string{"vehicle": `\"`}}
+	for _, e := range []Encoder{ThingsBoard{}, Flat{}, GeoJSON{}} {
+		out := encode(e.AppendAttributes(nil, g))
+		assert.True(json.Valid([]byte(out)), out)
+	}
+
+	assert.Equal(`{"device":"a\"b"}`, string(ThingsBoardDevice(`a"b`)))
+
+	var decoded map[string]map[string]string
+	assert.NoError(json.Unmarshal([]byte(encode(ThingsBoard{}.AppendAttributes(nil, g))), &decoded))
+	assert.Equal(map[string]map[string]string{"evil\"}],\"x\":[{\"\n\x01�": {"vehicle": `\"`}}, decoded)
+}
@@ -0,0 +1,123 @@
+package gpsparser
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// Reason is why a message or field could not be parsed
+// It is also an error itself, so callers can match a ParseError against it with errors.Is
+type Reason string
+
+func (r Reason) Error() string {
+	return string(r)
+}
+
+// All the reasons a message can be rejected for
+const (
+	ReasonEmpty         Reason = "empty message"
+	ReasonNoProtocol    Reason = "no protocol matched"
+	ReasonNotCSV        Reason = "not a CSV message"
+	ReasonFieldCount    Reason = "wrong number of fields"
+	ReasonBadHeader     Reason = "invalid packet header"
+	ReasonUnknownPacket Reason = "unsupported packet type"
+	ReasonNotNumber     Reason = "not a number"
+	ReasonNotBool       Reason = "not a bool"
+	ReasonOutOfRange    Reason = "out of range"
+	ReasonBadTime       Reason = "not a valid date and time"
+	ReasonBadCoordinate Reason = "not a valid coordinate"
+	ReasonBadHemisphere Reason = "not a valid hemisphere"
+	ReasonBadValue      Reason = "unexpected value"
+	ReasonBadChecksum   Reason = "checksum mismatch"
+	ReasonNoDevice      Reason = "device not identified"
+	ReasonBadFrame      Reason = "not a valid frame"
+)
+
+// ErrNoProtocol is returned when none of the registered protocols recognise the input
+var ErrNoProtocol error = ReasonNoProtocol
+
+// ParseError describes exactly where and why a message could not be parsed
+type ParseError struct {
+	Protocol   string // Protocol the message was being parsed as, empty if none matched
+	PacketType string // Packet type, empty if the error happened before it was known
+	Field      int    // Index of the offending field, -1 if the error is about the whole message
+	Value      string // The raw field (or message) that was rejected
+	Reason     Reason
+}
+
+func (e *ParseError) Error() string {
+	// Whole messages can be long, only the start is interesting in logs
+	value := e.Value
+	if len(value) > 64 {
+		value = value[:64] + "..."
+	}
+	if e.Field < 0 {
+		return fmt.Sprintf("%s: %s %q", e.where(), e.Reason, value)
+	}
+	return fmt.Sprintf("%s: field %d %q %s", e.where(), e.Field, value, e.Reason)
+}
+
+// Unwrap makes errors.Is(err, ReasonXXX) work
+func (e *ParseError) Unwrap() error {
+	return e.Reason
+}
+
+// Key is the error without the offending value, this is what errors are counted by
+// e.g. "AIS140 $1 field 13: not a bool"
+func (e *ParseError) Key() string {
+	if e.Field < 0 {
+		return fmt.Sprintf("%s: %s", e.where(), e.Reason)
+	}
+	return fmt.Sprintf("%s field %d: %s", e.where(), e.Field, e.Reason)
+}
+
+func (e *ParseError) where() string {
+	switch {
+	case e.Protocol == "":
+		return "unknown"
+	case e.PacketType == "":
+		return e.Protocol
+	default:
+		return e.Protocol + " " + e.PacketType
+	}
+}
+
+// The packet type of packets gpsparser does not know, the type as sent is left in the Value of the error about it
+// Types are never copied from the input, so that devices cannot make up new error counters without end
+const unknownPacketType = "unknown"
+
+// fieldError builds an error about a single field of the message g is being parsed from
+func fieldError(g *GPSParsed, field int, value string, reason Reason) *ParseError {
+	return &ParseError{Protocol: g.Protocol, PacketType: g.PacketType, Field: field, Value: value, Reason: reason}
+}
+
+// messageError builds an error about the whole message g is being parsed from
+func messageError(g *GPSParsed, message string, reason Reason) *ParseError {
+	return fieldError(g, -1, message, reason)
+}
+
+// Number of errors seen per ParseError.Key since start up
+// Published through expvar, so it shows up in /debug/vars when an HTTP server is running
+var errorCounts = expvar.NewMap("gpsparser_errors")
+
+// countErrors adds errs to the per reason error counters
+func countErrors(errs []error) {
+	for _, err := range errs {
+		if e, ok := err.(*ParseError); ok {
+			errorCounts.Add(e.Key(), 1)
+		} else {
+			errorCounts.Add(err.Error(), 1)
+		}
+	}
+}
+
+// ErrorCounts returns the number of errors seen per ParseError.Key since start up
+func ErrorCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	errorCounts.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			counts[kv.Key] = v.Value()
+		}
+	})
+	return counts
+}
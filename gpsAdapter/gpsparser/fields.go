@@ -0,0 +1,304 @@
+package gpsparser
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// These helpers work directly on the []byte the message came in, so parsing a valid message
+// does not allocate. Only failures allocate, to build the ParseError pointing at the bad field
+
+// errNoData is returned by frame parsers for frames that are valid but carry nothing to publish (keep alives)
+var errNoData = errors.New("no data")
+
+// parseFrames splits raw into messages ending in terminator and parses each non empty one with parse
+// Every message is parsed into a fresh record appended to records, failures are appended to errs instead
+func parseFrames(s *Session, records []GPSParsed, errs []error, raw []byte, terminator byte, parse func(s *Session, g *GPSParsed, message []byte) error) ([]GPSParsed, []error) {
+	for len(raw) > 0 {
+		message := raw
+		if i := bytes.IndexByte(raw, terminator); i >= 0 {
+			message, raw = raw[:i], raw[i+1:]
+		} else {
+			raw = nil
+		}
+
+		// Trailing newlines and the empty remainder after the last terminator are not messages
+		message = bytes.TrimSpace(message)
+		if len(message) == 0 {
+			continue
+		}
+
+		records = append(records, GPSParsed{})
+		if err := parse(s, &records[len(records)-1], message); err != nil {
+			records = records[:len(records)-1]
+			if err != errNoData {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return records, errs
+}
+
+// splitFields splits message on commas, appending the fields to fields
+// Pass a slice of a stack allocated array to keep this allocation free
+func splitFields(fields [][]byte, message []byte) [][]byte {
+	for {
+		i := bytes.IndexByte(message, ',')
+		if i < 0 {
+			return append(fields, message)
+		}
+		fields = append(fields, message[:i])
+		message = message[i+1:]
+	}
+}
+
+// The device IDs seen so far, so that every record of a device shares the same string
+// instead of allocating a new one per message
+var deviceIDs = struct {
+	sync.RWMutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+// Devices sending garbage IDs must not make the table grow forever
+const maxDeviceIDs = 100000
+
+// internID returns the device ID in b as a string, allocating only the first time it is seen
+func internID(b []byte) string {
+	deviceIDs.RLock()
+	id, ok := deviceIDs.ids[string(b)]
+	deviceIDs.RUnlock()
+	if ok {
+		return id
+	}
+
+	id = string(b)
+	deviceIDs.Lock()
+	if len(deviceIDs.ids) < maxDeviceIDs {
+		deviceIDs.ids[id] = id
+	}
+	deviceIDs.Unlock()
+	return id
+}
+
+// atoi parses a base 10 integer without allocating
+func atoi(b []byte) (int, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative {
+		b = b[1:]
+	}
+	// 18 digits always fit in an int64
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+// Powers of ten that are exactly representable as a float64
+var float64pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15}
+
+// atof parses a decimal number like 18.709738 without allocating
+// Dividing an exact integer mantissa by an exact power of ten gives the correctly rounded result,
+// anything that does not fit that (too many digits, exponents) goes through strconv
+func atof(b []byte) (float64, bool) {
+	s := b
+	negative := len(s) > 0 && (s[0] == '-' || s[0] == '+')
+	if negative {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	var mantissa uint64
+	digits, decimals, dot := 0, 0, false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			mantissa = mantissa*10 + uint64(c-'0')
+			digits++
+			if dot {
+				decimals++
+			}
+		case c == '.' && !dot:
+			dot = true
+		default:
+			digits = len(float64pow10) + 1
+		}
+	}
+
+	if digits == 0 || digits >= len(float64pow10) {
+		f, err := strconv.ParseFloat(string(b), 64)
+		return f, err == nil && finite(f)
+	}
+	f := float64(mantissa) / float64pow10[decimals]
+	if negative {
+		f = -f
+	}
+	return f, true
+}
+
+// These helpers parse a single CSV field of the message g is being parsed from
+// On failure they return a ParseError pointing at that field
+
+// intField parses field i as an integer and makes sure it lies within [min, max]
+func intField(g *GPSParsed, fields [][]byte, i int, min int, max int) (int, error) {
+	v, ok := atoi(fields[i])
+	if !ok {
+		return 0, fieldError(g, i, string(fields[i]), ReasonNotNumber)
+	}
+	if v < min || v > max {
+		return 0, fieldError(g, i, string(fields[i]), ReasonOutOfRange)
+	}
+	return v, nil
+}
+
+// floatField parses field i as a float and makes sure it lies within [min, max]
+func floatField(g *GPSParsed, fields [][]byte, i int, min float64, max float64) (float64, error) {
+	v, ok := atof(fields[i])
+	if !ok {
+		return 0, fieldError(g, i, string(fields[i]), ReasonNotNumber)
+	}
+	if v < min || v > max {
+		return 0, fieldError(g, i, string(fields[i]), ReasonOutOfRange)
+	}
+	return v, nil
+}
+
+// boolField parses field i as a bool, accepting the same spellings as strconv.ParseBool
+func boolField(g *GPSParsed, fields [][]byte, i int) (bool, error) {
+	switch string(fields[i]) {
+	case "1", "t", "T", "true", "TRUE", "True":
+		return true, nil
+	case "0", "f", "F", "false", "FALSE", "False":
+		return false, nil
+	}
+	return false, fieldError(g, i, string(fields[i]), ReasonNotBool)
+}
+
+// fixField parses the GPS fix validity at field i, A for a valid fix and V for an invalid one
+// Returns true when the fix is invalid
+func fixField(g *GPSParsed, fields [][]byte, i int) (bool, error) {
+	switch string(fields[i]) {
+	case "A":
+		return false, nil
+	case "V":
+		return true, nil
+	default:
+		return false, fieldError(g, i, string(fields[i]), ReasonBadValue)
+	}
+}
+
+// timeField parses the ddmmyy field at date and the hhmmss field at clock, both in UTC, into unix millis
+func timeField(g *GPSParsed, fields [][]byte, date int, clock int) (int64, error) {
+	ms, ok := unixMillis(fields[date], fields[clock])
+	if !ok {
+		return 0, fieldError(g, date, string(fields[date])+":"+string(fields[clock]), ReasonBadTime)
+	}
+	return ms, nil
+}
+
+// unixMillis converts a ddmmyy date and a hhmmss time in UTC into unix millis
+// It accepts exactly what time.Parse(TIMEDATEFORMAT) does, two digit years map to 1969-2068
+func unixMillis(date []byte, clock []byte) (int64, bool) {
+	if len(date) != 6 || len(clock) != 6 {
+		return 0, false
+	}
+	var n [6]int
+	for i := 0; i < 3; i++ {
+		d, ok := twoDigits(date[2*i:])
+		c, ok2 := twoDigits(clock[2*i:])
+		if !ok || !ok2 {
+			return 0, false
+		}
+		n[i], n[3+i] = d, c
+	}
+	day, month, year, hour, minute, second := n[0], n[1], n[2], n[3], n[4], n[5]
+	if year < 69 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	if month < 1 || month > 12 || day < 1 || hour > 23 || minute > 59 || second > 59 {
+		return 0, false
+	}
+
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	// time.Date normalises the 31st of February into March, that is not a valid date
+	if t.Day() != day {
+		return 0, false
+	}
+	// Thingsboard wants the time in millis
+	return t.Unix() * 1000, true
+}
+
+func twoDigits(b []byte) (int, bool) {
+	if b[0] < '0' || b[0] > '9' || b[1] < '0' || b[1] > '9' {
+		return 0, false
+	}
+	return int(b[0]-'0')*10 + int(b[1]-'0'), true
+}
+
+// nmeaField converts the NMEA style coordinate (ddmm.mmmm / dddmm.mmmm) at field i and its
+// hemisphere (N/S/E/W) at field i+1 into signed decimal degrees
+func nmeaField(g *GPSParsed, fields [][]byte, i int) (float64, error) {
+	v, reason := nmeaDegrees(fields[i], fields[i+1])
+	switch reason {
+	case "":
+		return v, nil
+	case ReasonBadHemisphere:
+		return 0, fieldError(g, i+1, string(fields[i+1]), reason)
+	default:
+		return 0, fieldError(g, i, string(fields[i]), reason)
+	}
+}
+
+// nmeaDegrees converts an NMEA style coordinate (ddmm.mmmm for latitude, dddmm.mmmm for longitude)
+// and its hemisphere (N/S/E/W) into signed decimal degrees
+func nmeaDegrees(value []byte, hemisphere []byte) (float64, Reason) {
+	raw, ok := atof(value)
+	if !ok || raw < 0 {
+		return 0, ReasonBadCoordinate
+	}
+
+	// Everything above the last two integer digits is degrees, the rest is minutes
+	degrees := math.Floor(raw / 100)
+	minutes := raw - degrees*100
+	if minutes >= 60 {
+		return 0, ReasonBadCoordinate
+	}
+	decimal := degrees + minutes/60
+
+	// The hemisphere tells a latitude from a longitude
+	limit := 180.0
+	switch string(hemisphere) {
+	case "N", "S":
+		limit = 90
+	case "E", "W":
+	default:
+		return 0, ReasonBadHemisphere
+	}
+	if decimal > limit {
+		return 0, ReasonOutOfRange
+	}
+	if hemisphere[0] == 'S' || hemisphere[0] == 'W' {
+		decimal = -decimal
+	}
+	return decimal, ""
+}
+
+// knotsToKmph converts a speed in knots into km/h, rounded to the nearest whole km/h
+func knotsToKmph(knots float64) int {
+	return int(math.Round(knots * 1.852))
+}
@@ -0,0 +1,86 @@
+package gpsparser
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FixPolicy decides what happens to the position of a packet that was sent without a valid GPS fix
+// Whatever the policy, such packets are published with "valid": false
+type FixPolicy int
+
+const (
+	// FixFlag publishes the position as the device sent it
+	FixFlag FixPolicy = iota
+	// FixDrop publishes the packet without a position
+	FixDrop
+	// FixLastKnown replaces the position with the last valid one seen from the same device
+	// The position is dropped if there is none yet
+	FixLastKnown
+)
+
+var fixPolicyNames = map[FixPolicy]string{
+	FixFlag:      "flag",
+	FixDrop:      "drop",
+	FixLastKnown: "last-known",
+}
+
+func (p FixPolicy) String() string {
+	if name, ok := fixPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("FixPolicy(%d)", int(p))
+}
+
+// ParseFixPolicy returns the policy with the given name (flag, drop or last-known)
+func ParseFixPolicy(name string) (FixPolicy, error) {
+	for p, n := range fixPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fix policy %q", name)
+}
+
+// The current policy and the last valid position of every device, for FixLastKnown
+var fixes = struct {
+	sync.Mutex
+	policy    FixPolicy
+	lastKnown map[string][2]float64
+}{lastKnown: make(map[string][2]float64)}
+
+// SetFixPolicy changes the policy applied to packets parsed from now on, the default is FixFlag
+func SetFixPolicy(p FixPolicy) {
+	fixes.Lock()
+	fixes.policy = p
+	fixes.Unlock()
+}
+
+// applyFixPolicy remembers valid positions and handles invalid ones according to the current policy
+func applyFixPolicy(g *GPSParsed) {
+	if g.NoPosition {
+		return
+	}
+
+	fixes.Lock()
+	defer fixes.Unlock()
+
+	if !g.InvalidFix {
+		// Capped like the device IDs, devices past that are not remembered
+		if _, ok := fixes.lastKnown[g.Uniqid]; ok || len(fixes.lastKnown) < maxDeviceIDs {
+			fixes.lastKnown[g.Uniqid] = [2]float64{g.ActualLat, g.ActualLng}
+		}
+		return
+	}
+
+	switch fixes.policy {
+	case FixDrop:
+		g.NoPosition = true
+	case FixLastKnown:
+		if last, ok := fixes.lastKnown[g.Uniqid]; ok {
+			g.ActualLat, g.ActualLng = last[0], last[1]
+		} else {
+			g.NoPosition = true
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package gpsparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixPolicy(t *testing.T) {
+	assert := assert.New(t)
+	defer SetFixPolicy(FixFlag)
+
+	valid := []byte("GTPL $1,1001,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,14,1,0,26.4470#")
+	invalid := []byte("*ZJ,1001,V1,062805,V,0000.0000,N,00000.0000,E,0.00,0.00,290518,00000000#")
+
+	// Flag keeps the position the device sent
+	SetFixPolicy(FixFlag)
+	records, errs := ParseMessages(invalid)
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		assert.True(records[0].InvalidFix)
+		assert.False(records[0].NoPosition)
+		assert.Equal(0.0, records[0].ActualLat)
+		assert.Contains(encode(ThingsBoard{}.AppendTelemetry(nil, &records[0])), `"valid":false`)
+	}
+
+	// Drop removes it
+	SetFixPolicy(FixDrop)
+	records, _ = ParseMessages(invalid)
+	if assert.Len(records, 1) {
+		assert.True(records[0].NoPosition)
+		assert.NotContains(encode(ThingsBoard{}.AppendTelemetry(nil, &records[0])), `"lat"`)
+		assert.Contains(encode(ThingsBoard{}.AppendTelemetry(nil, &records[0])), `"valid":false`)
+	}
+
+	// Last known uses the last valid position of the same device
+	SetFixPolicy(FixLastKnown)
+	records, _ = ParseMessages([]byte("*ZJ,1002,V1,062805,V,0000.0000,N,00000.0000,E,0.00,0.00,290518,00000000#"))
+	if assert.Len(records, 1) {
+		assert.True(records[0].NoPosition)
+	}
+	ParseMessages(valid)
+	records, _ = ParseMessages(invalid)
+	if assert.Len(records, 1) {
+		assert.False(records[0].NoPosition)
+		assert.Equal(18.709738, records[0].ActualLat)
+		assert.Equal(80.068397, records[0].ActualLng)
+	}
+
+	p, err := ParseFixPolicy("last-known")
+	assert.NoError(err)
+	assert.Equal(FixLastKnown, p)
+	_, err = ParseFixPolicy("ignore")
+	assert.Error(err)
+}
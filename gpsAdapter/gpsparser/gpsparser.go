@@ -1,17 +1,13 @@
 package gpsparser
 
 import (
-	"bytes"
-	"fmt"
-	"log"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
-// Currently supports AIS140
+// A single message parsed from any of the registered protocols
 type GPSParsed struct {
-	Raw            *string // Just a copy of the raw data that was parsed
+	Raw            []byte  // The raw message this was parsed from, shares memory with the parsed input
 	Protocol       string  // Which protocol this message was parsed as
 	PacketType     string  // Type of packet (Status? Alert? OverSpeed?)
 	Uniqid         string  // Unique identifier (Used as device ID)
@@ -23,261 +19,186 @@ type GPSParsed struct {
 	Direction      int
 	NoOfSatellites int
 	StatusBox      bool    //true = Box Open, false = Box Closed
-	GSMSignal      int     // Signal Strength
+	GSMSignal      int     // Signal Strength, -1 when the device does not know it
 	StatusBattery  bool    // true = Battery Connected, false = Battery Disconnected
 	BatteryLow     bool    // true = Battery Low, false = Battery Normal
 	StatusIgnition bool    // true = Ignition on, false = Ignition off
 	Voltage        float64 // Analog voltage
+	Alert          string  // Alert raised by this packet, empty for plain status packets
+	NoPosition     bool    // true for packets that carry no location (login, health), or whose position was dropped
+	InvalidFix     bool    // true when the device reported that it has no valid GPS fix (V instead of A)
+	BatteryPercent int     // Internal battery charge in percent
+	MemoryPercent  int     // Device memory used in percent
+	DigitalIO      string  // Digital IO pin states, one 0 or 1 per pin
+	AnalogIO       string  // Analog IO pin states, one 0 or 1 per pin
+	FixQuality     int     // GPS fix quality, 0 = no fix, 1 = GPS fix, 2 = differential fix...
+	Altitude       float64 // Altitude above mean sea level in metres
+
+	// Device attributes (firmware, vehicle...) that are published to ThingsBoard as attributes instead of telemetry
+	Attributes map[string]string
+
+	// Extra values reported by the device (Teltonika IO elements, OsmAnd battery...) keyed by their telemetry key
+	// Values are int64, float64 or strings
+	IO map[string]interface{}
 }
 
-const (
-	TIMEDATEFORMAT = "020106:150405"
-	DEBUGGING      = false
-)
+// Envelope carries a parsed record from the connection it came in on to where it is published
+// It is what goes through the channel given to Parse, records are only encoded at the end, see Publications
+type Envelope struct {
+	Device     string    // The device the record is from
+	Protocol   string    // The protocol the record was parsed as
+	Conn       string    // The connection the record came in on, see Session.Conn
+	ReceivedAt time.Time // When the message holding the record was received
+	Alert      string    // The alert raised by the record, empty for plain status records
+	Record     GPSParsed // The record itself, it does not share memory with anything
+}
 
-// Parse function takes in a raw string and puts its GPS data in the channel
-// Silently fails if it cannot parse
-func Parse(raw *string, c chan *string) {
-	if *raw == "" {
-		if DEBUGGING {
-			log.Printf("Empty message received")
-		}
-		return
-	}
+// An encoded payload for Device, ready to be published on Topic
+// Gateway tells that Topic is a Gateway API one, Device has to be connected through TopicConnect first
+type Publication struct {
+	Device  string
+	Topic   string
+	Gateway bool
+	Payload string
+}
 
-	if strings.HasPrefix(*raw, "GTPL") {
-		goto AIS140Parse
-	} else {
-		if DEBUGGING {
-			log.Printf("Invalid or unsupported protocol")
-		}
-		return
-	}
+// The ThingsBoard Gateway API topics
+const (
+	TopicConnect    = "v1/gateway/connect"
+	TopicDisconnect = "v1/gateway/disconnect"
+	TopicTelemetry  = "v1/gateway/telemetry"
+	TopicAttributes = "v1/gateway/attributes"
+)
 
-AIS140Parse:
-	g := &GPSParsed{}
-	g.Raw = raw
-	g.Protocol = "AIS140"
+const (
+	TIMEDATEFORMAT = "020106:150405"
+)
 
-	// This format can have multiple messages delimited by #
-	messages := strings.Split(*raw, "#")
+// The alerts that can be raised by a packet, these are published as is in the "alert" telemetry key
+const (
+	AlertIgnitionOn          = "Ignition on"
+	AlertIgnitionOff         = "Ignition off"
+	AlertBatteryConnected    = "Battery connected"
+	AlertBatteryDisconnected = "Battery disconnected"
+	AlertBatteryLow          = "Battery low"
+	AlertHarshAcceleration   = "Harsh Acceleration"
+	AlertHarshBraking        = "Harsh Braking"
+	AlertOverSpeed           = "OverSpeeding Alert"
+	AlertBoxOpened           = "Box Opened"
+	AlertBoxClosed           = "Box Closed"
+	AlertSOS                 = "SOS"
+	AlertEmergency           = "Emergency"
+	AlertEmergencyStopped    = "Emergency stopped"
+	AlertVibration           = "Vibration"
+	AlertGeofenceEnter       = "Geofence entered"
+	AlertGeofenceExit        = "Geofence exited"
+)
 
-	for _, message := range messages {
-		fields := strings.Split(message, ",")
-		if len(fields) == 1 {
-			if DEBUGGING {
-				log.Printf("Not a CSV message: %s", message)
-			}
-			continue
-		}
-		switch len(fields) {
-		case 10:
-			break
-		case 18:
-			break
-		default:
-			if DEBUGGING {
-				log.Printf("Invalid number of fields in CSV: %s", message)
-			}
-			continue
+// Parse function takes in a raw string and puts an Envelope for every record of GPS data in it in the channel
+// Returns an error for every message in raw that could not be parsed
+// Nothing is remembered from one call to the next, use a Parser per connection for protocols that need a Session
+func Parse(raw *string, c chan *Envelope) []error {
+	p := parserPool.Get().(*Parser)
+	defer parserPool.Put(p)
 
-		}
+	p.Session, p.Protocol = Session{}, nil
+	p.input = append(p.input[:0], *raw...)
+	return p.Publish(p.input, c)
+}
 
-		// 0th field has GTPL $1, GTPL $2 etc for different types of packets
-		g.PacketType = strings.Split(fields[0], " ")[1]
+// ParseBytes is Parse for data that is already in a []byte, like what comes off the network
+// raw is not used anymore once ParseBytes returns, so the caller can reuse it
+func ParseBytes(raw []byte, c chan *Envelope) []error {
+	p := parserPool.Get().(*Parser)
+	defer parserPool.Put(p)
 
-		// For any packet type we have the following fields Uniqid, TimeDate, Lat, Long
-		g.Uniqid = fields[1]
-		Yy_mm_dd_hh_mm_ss := strings.Join([]string{fields[3], fields[4]}, ":")
-		timestamp, e := time.Parse(TIMEDATEFORMAT, Yy_mm_dd_hh_mm_ss)
-		if e != nil {
-			if DEBUGGING {
-				log.Printf("%s", e)
-			}
-		}
-		// GPSParser returns in unix seconds, but thingsboard wants it in millis
-		g.TS_Millis = timestamp.Unix() * 1000
+	p.Session, p.Protocol = Session{}, nil
+	return p.Publish(raw, c)
+}
 
-		// 5th field contains latitude as a float
-		if lat, err := strconv.ParseFloat(fields[5], 64); err != nil {
-			if DEBUGGING {
-				log.Printf("Parsing error for latitude %s", fields[5])
-			}
-			continue
-		} else {
-			g.ActualLat = float64(lat)
-		}
-		// 6th field contains latitude direction information
-		if fields[6] == "S" {
-			g.ActualLat = -g.ActualLat
-		}
+// Publish parses raw like Parse does, but within the Session of p and with the buffers of p
+// raw is not used anymore once Publish returns, so the caller can reuse it
+func (p *Parser) Publish(raw []byte, c chan *Envelope) []error {
+	receivedAt := time.Now()
+	records, errs := p.ParseMessages(raw)
+	// errs is reused by the next call to p, the caller gets its own copy
+	if len(errs) > 0 {
+		errs = append([]error(nil), errs...)
+	} else {
+		errs = nil
+	}
 
-		// 7th field contains longitude as a float
-		if lng, err := strconv.ParseFloat(fields[7], 64); err != nil {
-			if DEBUGGING {
-				log.Printf("Parsing error for longitude %s", fields[7])
-			}
-			continue
-		} else {
-			g.ActualLng = float64(lng)
-		}
-		// 8th field contains lngitude direction information
-		if fields[8] == "W" {
-			g.ActualLng = -g.ActualLng
+	for i := range records {
+		e := &Envelope{
+			Device:     records[i].Uniqid,
+			Protocol:   records[i].Protocol,
+			Conn:       p.Session.Conn,
+			ReceivedAt: receivedAt,
+			Alert:      records[i].Alert,
+			Record:     records[i],
 		}
+		// The record shares memory with raw, which the caller reuses
+		e.Record.Raw = append([]byte(nil), records[i].Raw...)
+		c <- e
+	}
+	return errs
+}
 
-		var jsonBuffer bytes.Buffer
-		jsonBuffer.WriteString("{") // Start the Json Object
-		// Add whatever we've parsed so far into the JSON Object
-		jsonBuffer.WriteString(fmt.Sprintf(`"%s":[{"ts":%d,"values":{"latitude":%f,"longitude":%f`, g.Uniqid, g.TS_Millis, g.ActualLat, g.ActualLng))
-		//Note that no comma has been inserted at the end
-
-		// Now each packetType has its own specific parameters and syntax
-		switch g.PacketType {
-		// Status packet ($1)
-		case "$1":
-			if speed, err := strconv.ParseInt(fields[9], 10, 64); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for speed %s", fields[9])
-				}
-				continue
-			} else {
-				g.Speed = int(speed)
-
-				// Add the parsed Speed to the json
-				jsonBuffer.WriteString(fmt.Sprintf(`,"speed":%d`, g.Speed))
-			}
-
-			if boxOpen, err := strconv.ParseBool(fields[13]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for boxOpen %s", fields[13])
-				}
-				continue
-			} else {
-				g.StatusBox = boxOpen
-
-				// Add the box Status to json
-				// Adds true or false (Json booleans)
-				jsonBuffer.WriteString(fmt.Sprintf(`,"box":%v`, g.StatusBox))
-			}
+// ParseMessages detects the protocol of raw and returns a freshly filled record for each message
+// in it that could be parsed, along with a *ParseError for every message that could not
+// Every error is also counted, see ErrorCounts
+func ParseMessages(raw []byte) (records []GPSParsed, errs []error) {
+	return new(Parser).ParseMessages(raw)
+}
 
-			if batConnected, err := strconv.ParseBool(fields[15]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for batConnected %s", fields[15])
-				}
-				continue
-			} else {
-				g.StatusBattery = batConnected
+// Parser parses messages like ParseMessages, but reuses its buffers from one call to the next
+// so that parsing valid messages does not allocate at all once it has warmed up
+// A Parser must not be used from multiple goroutines at once
+type Parser struct {
+	// What is known about the connection the messages come from, see NewParser
+	Session Session
+	// The protocol messages are parsed in, nil to detect it from every message
+	Protocol Protocol
 
-				// Add the battery Status to json
-				// Adds true or false (Json booleans)
-				jsonBuffer.WriteString(fmt.Sprintf(`,"bat":%v`, g.StatusBattery))
-			}
+	records []GPSParsed
+	errs    []error
 
-			if ignition, err := strconv.ParseBool(fields[16]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for ignition %s", fields[16])
-				}
-				continue
-			} else {
-				g.StatusIgnition = ignition
+	// Buffer used by Parse
+	input []byte
+}
 
-				// Add the ignition Status to json
-				// Adds true or false (Json booleans)
-				jsonBuffer.WriteString(fmt.Sprintf(`,"ign":%v`, g.StatusIgnition))
-			}
-		// Ignition Alert packet ($2)
-		case "$2":
-			if ignition, err := strconv.ParseBool(fields[9]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for ignition %s", fields[9])
-				}
-				continue
-			} else {
-				g.StatusIgnition = ignition
-				if ignition {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Ignition on"))
-				} else {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Ignition off"))
-				}
-			}
-		// Main Battery Alert packet ($3)
-		case "$3":
-			if batConnected, err := strconv.ParseBool(fields[9]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for batConnected %s", fields[9])
-				}
-				continue
-			} else {
-				g.StatusBattery = batConnected
-				if batConnected {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Battery connected"))
-				} else {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Battery disconnected"))
-				}
-			}
-		// Low Battery Alert packet ($4)
-		case "$4":
-			jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Battery low"))
-		// Harsh Acceleration Alert packet ($5)
-		case "$5":
-			jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Harsh Acceleration"))
-		// Harsh Braking Alert packet ($6)
-		case "$6":
-			jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Harsh Braking"))
-		// Overspeeding Alert packet ($7)
-		case "$7":
-			jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "OverSpeeding Alert"))
-			if speed, err := strconv.ParseInt(fields[9], 10, 64); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for speed %s", fields[9])
-				}
-				continue
-			} else {
-				g.Speed = int(speed)
+// Parsers used by Parse, so that it does not have to allocate new buffers for every call
+var parserPool = sync.Pool{New: func() interface{} { return new(Parser) }}
 
-				// Add the parsed Speed to the json
-				jsonBuffer.WriteString(fmt.Sprintf(`,"speed":%d`, g.Speed))
-			}
-		// Box Alert packet ($8)
-		case "$8":
-			if boxOpen, err := strconv.ParseBool(fields[9]); err != nil {
-				if DEBUGGING {
-					log.Printf("Parsing error for boxOpen %s", fields[9])
-				}
-				continue
-			} else {
-				g.StatusBattery = boxOpen
-				if boxOpen {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Box Opened"))
-				} else {
-					jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "Box Closed"))
-				}
-			}
-		// SOS Alert packet ($9)
-		case "$9":
-			jsonBuffer.WriteString(fmt.Sprintf(`,"alert":"%s"`, "SOS"))
-		}
+// ParseMessages detects the protocol of raw and returns a record for each message in it that could be parsed,
+// along with a *ParseError for every message that could not. Every error is also counted, see ErrorCounts
+// The returned slices are only valid until the next call, and the records share memory with raw
+func (p *Parser) ParseMessages(raw []byte) (records []GPSParsed, errs []error) {
+	defer func() { countErrors(errs) }()
 
-		jsonBuffer.WriteString(`}}]}`)
-		jsonString := jsonBuffer.String()
-		c <- &jsonString
-		// c <- g
-		if DEBUGGING {
-			log.Printf("Parsed dumped")
-		}
+	if len(raw) == 0 {
+		return nil, []error{&ParseError{Field: -1, Reason: ReasonEmpty}}
 	}
-	// if len(fields) == 1 {
-	// 	return fmt.Errorf("Not a CSV message: %s", message)
-	// }
-
-	// if len(fields) != 13 {
-	// 	return nil, fmt.Errorf("Incorrect number of fields in CSV: %d", len(fields))
-	// }
-	// g.Uniqid = fields[1]
 
-	// // Thingsboard expects time in miilis since epoch
-	// _ = timestamp
+	protocol := p.Protocol
+	if protocol == nil {
+		protocol = Detect(raw)
+	}
+	if protocol == nil {
+		return nil, []error{&ParseError{Field: -1, Value: string(raw), Reason: ReasonNoProtocol}}
+	}
 
-	// return
+	// Clear the previous records, so maps and slices they held can be garbage collected
+	for i := range p.records {
+		p.records[i] = GPSParsed{}
+	}
+	for i := range p.errs {
+		p.errs[i] = nil
+	}
+	p.records, p.errs = protocol.Parse(&p.Session, p.records[:0], p.errs[:0], raw)
+	for i := range p.records {
+		applyFixPolicy(&p.records[i])
+		applyAlertRules(&p.records[i])
+	}
+	return p.records, p.errs
 }
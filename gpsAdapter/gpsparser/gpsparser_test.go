@@ -1,7 +1,9 @@
 package gpsparser
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -26,14 +28,21 @@ var tests = []testpair{
 	{
 		input: "GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,14,1,0,26.4470#",
 		expected: []string{
-			`{"867322035135813":[{"ts":1527575284000,"values":{"lat":18.709738,"lng":80.068397,"speed":0,"box":false,"bat":true,"ign":false}}]}`,
+			`{"867322035135813":[{"ts":1527575284000,"values":{"lat":18.709738,"lng":80.068397,"speed":0,"odo":406,"dir":309,"sats":11,"box":false,"gsm":14,"bat":true,"ign":false,"volt":26.447}}]}`,
 		},
 	},
 	// Valid single Status packet (SW)
 	{
 		input: "GTPL $1,867322035135813,A,290518,062804,18.709738,S,80.068397,W,0,406,309,11,0,14,1,0,26.4470#",
 		expected: []string{
-			`{"867322035135813":[{"ts":1527575284000,"values":{"lat":-18.709738,"lng":-80.068397,"speed":0,"box":false,"bat":true,"ign":false}}]}`,
+			`{"867322035135813":[{"ts":1527575284000,"values":{"lat":-18.709738,"lng":-80.068397,"speed":0,"odo":406,"dir":309,"sats":11,"box":false,"gsm":14,"bat":true,"ign":false,"volt":26.447}}]}`,
+		},
+	},
+	// Status packet from a modem that does not know the signal yet (AT+CSQ 99)
+	{
+		input: "GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,99,1,0,26.4470#",
+		expected: []string{
+			`{"867322035135813":[{"ts":1527575284000,"values":{"lat":18.709738,"lng":80.068397,"speed":0,"odo":406,"dir":309,"sats":11,"box":false,"bat":true,"ign":false,"volt":26.447}}]}`,
 		},
 	},
 	// Ignition off Alert packet
@@ -59,7 +68,7 @@ var tests = []testpair{
 
 func TestParse(t *testing.T) {
 	assert := assert.New(t)
-	c := make(chan *string, 10)
+	c := make(chan *Envelope, 10)
 	for _, testCase := range tests {
 		Parse(&testCase.input, c)
 		// i := 0
@@ -74,7 +83,12 @@ func TestParse(t *testing.T) {
 		for _, expOutput := range testCase.expected {
 			select {
 			case output := <-c:
-				assert.Equal(expOutput, *output)
+				publications, err := output.Publications()
+				assert.NoError(err)
+				if assert.Len(publications, 1) {
+					assert.Equal(TopicTelemetry, publications[0].Topic)
+					assert.Equal(expOutput, publications[0].Payload)
+				}
 			case <-time.After(1 * time.Millisecond):
 				assert.Nil(expOutput)
 			}
@@ -82,6 +96,66 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	// Two messages in one batch must come out as two independent records
+	records, errs := ParseMessages([]byte("GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,14,1,0,26.4470#GTPL $9,867322035135814,A,290518,062805,18.709738,S,80.068397,W,0#\n"))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		assert.Equal("867322035135813", records[0].Uniqid)
+		assert.Equal("$1", records[0].PacketType)
+		assert.Equal(int64(1527575284000), records[0].TS_Millis)
+		assert.Equal(18.709738, records[0].ActualLat)
+		assert.Equal(80.068397, records[0].ActualLng)
+		assert.Equal(0, records[0].Speed)
+		assert.Equal(406, records[0].OdoMeter)
+		assert.Equal(309, records[0].Direction)
+		assert.Equal(11, records[0].NoOfSatellites)
+		assert.False(records[0].StatusBox)
+		assert.Equal(14, records[0].GSMSignal)
+		assert.True(records[0].StatusBattery)
+		assert.False(records[0].StatusIgnition)
+		assert.Equal(26.447, records[0].Voltage)
+		assert.Empty(records[0].Alert)
+
+		assert.Equal("867322035135814", records[1].Uniqid)
+		assert.Equal("$9", records[1].PacketType)
+		assert.Equal(int64(1527575285000), records[1].TS_Millis)
+		assert.Equal(-18.709738, records[1].ActualLat)
+		assert.Equal(-80.068397, records[1].ActualLng)
+		assert.False(records[1].StatusBattery)
+		assert.Equal(AlertSOS, records[1].Alert)
+	}
+
+	// A bad message is reported without losing the good ones around it
+	records, errs = ParseMessages([]byte("GTPL $1867322035135813A29051806280418.709738N80.068397E0406309110141026.4470#GTPL $2,867322035135813,A,290518,062804,18.709738,N,80.068397,E,1#"))
+	assert.Len(errs, 1)
+	if assert.Len(records, 1) {
+		assert.Equal(AlertIgnitionOn, records[0].Alert)
+		assert.True(records[0].StatusIgnition)
+	}
+
+	// Out of range status fields are rejected
+	for _, message := range []string{
+		"GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,361,11,0,14,1,0,26.4470#",
+		"GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,32,1,0,26.4470#",
+		"GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,-1,406,309,11,0,14,1,0,26.4470#",
+		"GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,0,14,1,0,volts#",
+	} {
+		records, errs = ParseMessages([]byte(message))
+		assert.Empty(records, message)
+		assert.Len(errs, 1, message)
+	}
+
+	// Unsupported input
+	records, errs = ParseMessages([]byte("hello"))
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ErrNoProtocol))
+	}
+}
+
 // var benchoutput *WTD
 // var bencherr error
 
@@ -105,8 +179,10 @@ var benchmarks = Bench{
 	"GTPL $1867322035135813A29051806280418.709738N80.068397E0406309110141026.4470#",
 }
 
+// Parses all 3 benchmark messages per op, through the string and channel based API
 func BenchmarkParse(b *testing.B) {
-	c := make(chan *string, 1000)
+	b.ReportAllocs()
+	c := make(chan *Envelope, 1000)
 	go ChanSinker(c)
 	for i := 0; i < b.N; i++ {
 		for _, input := range benchmarks {
@@ -115,8 +191,150 @@ func BenchmarkParse(b *testing.B) {
 	}
 }
 
-func ChanSinker(c chan *string) {
+// The benchmarks below parse and encode a single valid status message per op
+
+func BenchmarkParseMessages(b *testing.B) {
+	b.ReportAllocs()
+	raw := []byte(benchmarks[0])
+	for i := 0; i < b.N; i++ {
+		records, _ := ParseMessages(raw)
+		ThingsBoard{}.AppendTelemetry(nil, &records[0])
+	}
+}
+
+// The zero allocation path: a reused Parser and output buffer
+func BenchmarkParser(b *testing.B) {
+	b.ReportAllocs()
+	raw := []byte(benchmarks[0])
+	encoder := ThingsBoard{Keys: Keys{"lat": "latitude", "lng": "longitude"}}
+	var p Parser
+	var out []byte
+	for i := 0; i < b.N; i++ {
+		records, _ := p.ParseMessages(raw)
+		out, _ = encoder.AppendTelemetry(out[:0], &records[0])
+	}
+}
+
+func TestParserDoesNotAllocate(t *testing.T) {
+	raw := []byte(benchmarks[0])
+	var p Parser
+	var out []byte
+	allocs := testing.AllocsPerRun(100, func() {
+		records, _ := p.ParseMessages(raw)
+		out, _ = ThingsBoard{}.AppendTelemetry(out[:0], &records[0])
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestAtof(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []string{"0", "18.709738", "-80.068397", "+1.5", "26.4470", "1.", "0.000001", "123456789012345", "1234567890.123456789", "1e3"} {
+		f, ok := atof([]byte(s))
+		expected, err := strconv.ParseFloat(s, 64)
+		assert.True(ok, s)
+		assert.NoError(err, s)
+		assert.Equal(expected, f, s)
+	}
+	for _, s := range []string{"", ".", "-", "1.2.3", "abc", "NaN", "Inf"} {
+		_, ok := atof([]byte(s))
+		assert.False(ok, s)
+	}
+}
+
+func TestUnixMillis(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []string{"290518:062804", "010100:000000", "311268:235959", "010169:000000", "290224:120000"} {
+		ms, ok := unixMillis([]byte(s[:6]), []byte(s[7:]))
+		expected, err := time.Parse(TIMEDATEFORMAT, s)
+		assert.True(ok, s)
+		assert.NoError(err, s)
+		assert.Equal(expected.Unix()*1000, ms, s)
+	}
+	for _, s := range []string{"310218:000000", "290519:240000", "001318:000000", "29051a:000000", "290518:0628"} {
+		_, ok := unixMillis([]byte(s[:6]), []byte(s[7:]))
+		assert.False(ok, s)
+	}
+}
+
+func ChanSinker(c chan *Envelope) {
 	for {
 		<-c
 	}
 }
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Contains(Protocols(), "AIS140")
+	assert.Equal("AIS140", Lookup("AIS140").Name())
+	assert.Nil(Lookup("NoSuchProtocol"))
+
+	assert.Equal("AIS140", Detect([]byte("GTPL $9,867322035135813,A,290518,062804,18.709738,S,80.068397,W,0#")).Name())
+	assert.Nil(Detect([]byte("hello")))
+	assert.Panics(func() { Register(ais140{}) })
+
+	// A parser bound to a protocol does not detect anything
+	p := NewParser("10.1.2.3:5555")
+	p.Protocol = Lookup("ZJ")
+	_, errs := p.ParseMessages([]byte("GTPL $9,867322035135813,A,290518,062804,18.709738,S,80.068397,W,0#"))
+	if assert.Len(errs, 1) {
+		assert.Equal("ZJ", errs[0].(*ParseError).Protocol)
+		assert.True(errors.Is(errs[0], ReasonFieldCount))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	assert := assert.New(t)
+	before := ErrorCounts()
+
+	_, errs := ParseMessages([]byte("GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,x,14,1,0,26.4470#GTPL $1,867322035135813,A,290518,062804,18.709738,N,80.068397,E,0,406,309,11,2,14,1,0,26.4470#GTPL $1,867322035135813#"))
+	if assert.Len(errs, 3) {
+		e, ok := errs[0].(*ParseError)
+		if assert.True(ok) {
+			assert.Equal(ParseError{Protocol: "AIS140", PacketType: "$1", Field: 13, Value: "x", Reason: ReasonNotBool}, *e)
+			assert.Equal(`AIS140 $1: field 13 "x" not a bool`, e.Error())
+			assert.Equal("AIS140 $1 field 13: not a bool", e.Key())
+		}
+		assert.True(errors.Is(errs[1], ReasonNotBool))
+		assert.True(errors.Is(errs[2], ReasonFieldCount))
+		assert.Equal(-1, errs[2].(*ParseError).Field)
+	}
+
+	after := ErrorCounts()
+	assert.Equal(before["AIS140 $1 field 13: not a bool"]+2, after["AIS140 $1 field 13: not a bool"])
+	assert.Equal(before["AIS140 $1: wrong number of fields"]+1, after["AIS140 $1: wrong number of fields"])
+
+	// Packet types nobody knows all count under one key, whatever the device sent
+	_, errs = ParseMessages([]byte("*HQ,865205030330012,NBR1,062804#*HQ,865205030330012,NBR2,062804#"))
+	if assert.Len(errs, 2) {
+		assert.Equal("NBR2", errs[1].(*ParseError).Value)
+	}
+	after, before = ErrorCounts(), after
+	assert.Equal(before["H02 unknown field 2: unsupported packet type"]+2, after["H02 unknown field 2: unsupported packet type"])
+	for key := range after {
+		assert.NotContains(key, "NBR")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	assert := assert.New(t)
+	c := make(chan *Envelope, 10)
+
+	// The envelope says where the record comes from, and keeps its own copy of the message
+	p := NewParser("10.1.2.3:5555")
+	p.Session.Conn = "tcp/7"
+	raw := []byte("GTPL $9,867322035135813,A,290518,062804,18.709738,S,80.068397,W,0#")
+	assert.Empty(p.Publish(raw, c))
+	copy(raw, "XXXX")
+	select {
+	case output := <-c:
+		assert.Equal("867322035135813", output.Device)
+		assert.Equal("AIS140", output.Protocol)
+		assert.Equal("tcp/7", output.Conn)
+		assert.Equal(AlertSOS, output.Alert)
+		assert.WithinDuration(time.Now(), output.ReceivedAt, time.Second)
+		assert.Equal("GTPL $9", string(output.Record.Raw[:7]))
+	case <-time.After(time.Millisecond):
+		assert.Fail("missing envelope")
+	}
+}
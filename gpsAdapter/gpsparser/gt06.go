@@ -0,0 +1,344 @@
+package gpsparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// GT06 is the binary protocol of the GT06/Concox family of trackers
+// 0x78 0x78, length, protocol number, information content, serial number, CRC-ITU, 0x0D 0x0A
+// Packets with a lot of content start with 0x79 0x79 and have a two byte length instead
+// The length counts everything from the protocol number up to the CRC, and the CRC covers the length up to the serial number
+// The device logs in with its IMEI first, and does not send anything else until its login and heartbeats are acknowledged
+// For errors in GT06 packets ParseError.Field is the offset of the offending byte in the packet
+type gt06 struct{}
+
+func init() {
+	Register(gt06{})
+}
+
+func (gt06) Name() string {
+	return "GT06"
+}
+
+func (gt06) Detect(raw []byte) bool {
+	return len(raw) >= 2 && (raw[0] == 0x78 && raw[1] == 0x78 || raw[0] == 0x79 && raw[1] == 0x79)
+}
+
+// Split cuts the next packet off data using the length in its header
+func (gt06) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	size, err := gt06Size(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size == 0 || len(data) < size {
+		if atEOF && len(data) > 0 {
+			return 0, nil, ReasonBadFrame
+		}
+		return 0, nil, nil
+	}
+	return size, data[:size], nil
+}
+
+func (gt06) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	for len(raw) > 0 {
+		// A packet that does not fit what is left is cut short, the rest is parsed as one to report it
+		size, err := gt06Size(raw)
+		if err != nil || size == 0 || size > len(raw) {
+			size = len(raw)
+		}
+		packet := raw[:size]
+		raw = raw[size:]
+
+		records = append(records, GPSParsed{})
+		if err := parseGT06(s, &records[len(records)-1], packet); err != nil {
+			records = records[:len(records)-1]
+			if err != errNoData {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return records, errs
+}
+
+// The telemetry of the heartbeat, location and alarm packets, an alarm is a location along with the heartbeat status
+var (
+	gt06HeartbeatFields = []field{fieldIgn, fieldBat, fieldGSM, fieldBatPct, fieldBatLow}
+	gt06LocationFields  = []field{fieldSpeed, fieldDir, fieldSats}
+	gt06AlarmFields     = []field{fieldSpeed, fieldDir, fieldSats, fieldIgn, fieldBat, fieldGSM}
+)
+
+func (gt06) telemetry(g *GPSParsed) []field {
+	switch g.PacketType {
+	case "Heartbeat":
+		return gt06HeartbeatFields
+	case "Location":
+		return gt06LocationFields
+	case "Alarm":
+		return gt06AlarmFields
+	}
+	return nil
+}
+
+// GT06 protocol numbers
+const (
+	gt06Login     = 0x01
+	gt06Location  = 0x12
+	gt06Heartbeat = 0x13
+	gt06Alarm     = 0x16
+	gt06Location2 = 0x22 // Newer devices, the location packet with ACC and upload mode added at the end
+)
+
+// gt06Size returns the size of the packet at the start of data from its header, 0 if the header is not all there yet
+func gt06Size(data []byte) (int, error) {
+	switch {
+	case len(data) < 3:
+		if len(data) > 0 && data[0] != 0x78 && data[0] != 0x79 {
+			return 0, ReasonBadFrame
+		}
+		return 0, nil
+	case data[0] == 0x78 && data[1] == 0x78:
+		// Start, length and stop are not counted in the length
+		return int(data[2]) + 5, nil
+	case data[0] == 0x79 && data[1] == 0x79:
+		if len(data) < 4 {
+			return 0, nil
+		}
+		return int(binary.BigEndian.Uint16(data[2:])) + 6, nil
+	}
+	return 0, ReasonBadFrame
+}
+
+// parseGT06 checks the framing of a single packet and parses its content into g
+// Login, heartbeat and alarm packets are acknowledged through the session
+func parseGT06(s *Session, g *GPSParsed, packet []byte) error {
+	g.Raw = packet
+	g.Protocol = "GT06"
+
+	// Header, protocol number, serial number, CRC and stop
+	header := 3
+	if packet[0] == 0x79 {
+		header = 4
+	}
+	if len(packet) < header+7 || !bytes.HasSuffix(packet, []byte{0x0D, 0x0A}) {
+		return messageError(g, string(packet), ReasonBadFrame)
+	}
+	end := len(packet) - 4
+	if crcITU(packet[2:end]) != binary.BigEndian.Uint16(packet[end:]) {
+		return messageError(g, string(packet), ReasonBadChecksum)
+	}
+
+	number := packet[header]
+	content := packet[header+1 : end-2]
+	serial := packet[end-2 : end]
+	g.PacketType = gt06PacketType(number)
+
+	// The device has to log in before anything else, the login is the only packet carrying its IMEI
+	if number == gt06Login {
+		if len(content) < 8 {
+			return messageError(g, string(packet), ReasonFieldCount)
+		}
+		imei, ok := bcdDigits(content[:8])
+		if !ok {
+			return fieldError(g, header+1, string(content[:8]), ReasonNotNumber)
+		}
+		s.Device = internID(imei)
+		s.reply = gt06Ack(s.reply, number, serial)
+		return errNoData
+	}
+	if g.Uniqid = s.Device; g.Uniqid == "" {
+		return messageError(g, string(packet), ReasonNoDevice)
+	}
+
+	switch number {
+	case gt06Heartbeat:
+		// Terminal information, voltage level, GSM signal strength and language
+		if len(content) < 3 {
+			return messageError(g, string(packet), ReasonFieldCount)
+		}
+		g.TS_Millis = time.Now().UnixNano() / int64(time.Millisecond)
+		g.NoPosition = true
+		if err := gt06Status(g, content, header+1); err != nil {
+			return err
+		}
+		s.reply = gt06Ack(s.reply, number, serial)
+	case gt06Location, gt06Location2:
+		// Date and time, GPS, then the cell the device is in
+		if len(content) < 18 {
+			return messageError(g, string(packet), ReasonFieldCount)
+		}
+		if err := gt06Position(g, content, header+1); err != nil {
+			return err
+		}
+	case gt06Alarm:
+		// Same as a location, followed by the cell, the status of a heartbeat and what the alarm is about
+		if len(content) < 32 {
+			return messageError(g, string(packet), ReasonFieldCount)
+		}
+		if err := gt06Position(g, content, header+1); err != nil {
+			return err
+		}
+		// The cell information has its own length byte
+		status := 18 + int(content[18])
+		if len(content) < status+5 {
+			return messageError(g, string(packet), ReasonFieldCount)
+		}
+		if err := gt06Status(g, content[status:], header+1+status); err != nil {
+			return err
+		}
+		switch content[status+3] {
+		case 0x00:
+		case 0x01:
+			g.Alert = AlertSOS
+		case 0x02:
+			g.Alert = AlertBatteryDisconnected
+		case 0x03:
+			g.Alert = AlertVibration
+		case 0x04:
+			g.Alert = AlertGeofenceEnter
+		case 0x05:
+			g.Alert = AlertGeofenceExit
+		case 0x06:
+			g.Alert = AlertOverSpeed
+		default:
+			return fieldError(g, header+1+status+3, string(content[status+3:status+4]), ReasonBadValue)
+		}
+		s.reply = gt06Ack(s.reply, number, serial)
+	default:
+		return fieldError(g, header, string(packet[header:header+1]), ReasonUnknownPacket)
+	}
+	return nil
+}
+
+// gt06Position parses the date, time and GPS information at the start of location and alarm content
+// offset is where content starts in the packet, for errors
+func gt06Position(g *GPSParsed, content []byte, offset int) error {
+	// YY MM DD hh mm ss in UTC, one byte each
+	year, month, day := int(content[0]), int(content[1]), int(content[2])
+	hour, minute, second := int(content[3]), int(content[4]), int(content[5])
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 59 {
+		return fieldError(g, offset, string(content[:6]), ReasonBadTime)
+	}
+	g.TS_Millis = time.Date(2000+year, time.Month(month), day, hour, minute, second, 0, time.UTC).Unix() * 1000
+
+	// The low nibble is the number of satellites
+	g.NoOfSatellites = int(content[6] & 0x0F)
+
+	// Coordinates are in 1/30000ths of a minute, the hemispheres are in the course
+	lat := float64(binary.BigEndian.Uint32(content[7:])) / 1800000
+	lng := float64(binary.BigEndian.Uint32(content[11:])) / 1800000
+	if lat > 90 {
+		return fieldError(g, offset+7, string(content[7:11]), ReasonOutOfRange)
+	}
+	if lng > 180 {
+		return fieldError(g, offset+11, string(content[11:15]), ReasonOutOfRange)
+	}
+	g.Speed = int(content[15])
+
+	// The course and status word: bit 12 is set when the position is fixed, bit 11 for west and bit 10 for north
+	// The lowest 10 bits are the course in degrees
+	course := binary.BigEndian.Uint16(content[16:])
+	g.InvalidFix = course&0x1000 == 0
+	if course&0x0400 == 0 {
+		lat = -lat
+	}
+	if course&0x0800 != 0 {
+		lng = -lng
+	}
+	g.ActualLat, g.ActualLng = lat, lng
+	g.Direction = int(course & 0x03FF)
+	if g.Direction > 360 {
+		return fieldError(g, offset+16, string(content[16:18]), ReasonOutOfRange)
+	}
+	return nil
+}
+
+// gt06Status parses the terminal information, voltage level and GSM signal strength of heartbeat and alarm content
+func gt06Status(g *GPSParsed, content []byte, offset int) error {
+	// Bit 1 is set when ACC is high and bit 2 when the device is charging from the vehicle
+	info := content[0]
+	g.StatusIgnition = info&0x02 != 0
+	g.StatusBattery = info&0x04 != 0
+
+	// The voltage level goes from 0 (no power) to 6 (very high), and the GSM signal from 0 (none) to 4 (strong)
+	if content[1] > 6 {
+		return fieldError(g, offset+1, string(content[1:2]), ReasonOutOfRange)
+	}
+	if content[2] > 4 {
+		return fieldError(g, offset+2, string(content[2:3]), ReasonOutOfRange)
+	}
+	g.BatteryPercent = int(content[1]) * 100 / 6
+	g.BatteryLow = content[1] <= 2
+	g.GSMSignal = int(content[2])
+	return nil
+}
+
+// gt06Ack appends the acknowledgement of the packet with the given protocol number and serial number to b
+func gt06Ack(b []byte, number byte, serial []byte) []byte {
+	start := len(b)
+	b = append(b, 0x78, 0x78, 0x05, number, serial[0], serial[1])
+	crc := crcITU(b[start+2:])
+	return append(b, byte(crc>>8), byte(crc), 0x0D, 0x0A)
+}
+
+// gt06PacketType names the packet types we understand, so they do not allocate
+func gt06PacketType(number byte) string {
+	switch number {
+	case gt06Login:
+		return "Login"
+	case gt06Heartbeat:
+		return "Heartbeat"
+	case gt06Location, gt06Location2:
+		return "Location"
+	case gt06Alarm:
+		return "Alarm"
+	}
+	const hex = "0123456789ABCDEF"
+	return "0x" + string([]byte{hex[number>>4], hex[number&0x0F]})
+}
+
+// bcdDigits decodes packed BCD, the IMEI is 15 digits sent as 8 bytes with a leading 0
+func bcdDigits(b []byte) ([]byte, bool) {
+	var digits [16]byte
+	n := 0
+	for _, c := range b {
+		if c>>4 > 9 || c&0x0F > 9 {
+			return nil, false
+		}
+		digits[n], digits[n+1] = '0'+c>>4, '0'+c&0x0F
+		n += 2
+	}
+	// Drop the padding
+	d := digits[:n]
+	for len(d) > 1 && d[0] == '0' {
+		d = d[1:]
+	}
+	return d, true
+}
+
+// The CRC-ITU (CRC-16/X-25) lookup table
+var crcTable [256]uint16
+
+func init() {
+	for i := range crcTable {
+		crc := uint16(i)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+		crcTable[i] = crc
+	}
+}
+
+// crcITU computes the CRC-ITU of b, as used by GT06
+func crcITU(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, c := range b {
+		crc = crc>>8 ^ crcTable[byte(crc)^c]
+	}
+	return ^crc
+}
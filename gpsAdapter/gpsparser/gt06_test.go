@@ -0,0 +1,113 @@
+package gpsparser
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gt06Packet builds a packet from its hex length, protocol number, content and serial, adding the CRC and stop bits
+func gt06Packet(s string) []byte {
+	b, _ := hex.DecodeString("7878" + strings.Replace(s, " ", "", -1))
+	crc := crcITU(b[2:])
+	return append(b, byte(crc>>8), byte(crc), 0x0D, 0x0A)
+}
+
+func gt06Hex(s string) []byte {
+	b, _ := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	return b
+}
+
+func TestParseGT06(t *testing.T) {
+	assert := assert.New(t)
+	p := NewParser("10.1.2.3:5555")
+
+	// Nothing is accepted before the device logs in
+	location := gt06Hex("78 78 1F 12 0B 08 1D 11 2E 10 CF 02 7A C7 EB 0C 46 58 49 00 14 8F 01 CC 00 28 7D 00 1F B8 00 03 80 81 0D 0A")
+	records, errs := p.ParseMessages(location)
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ReasonNoDevice))
+	}
+
+	// The login from the protocol manual, and its acknowledgement
+	records, errs = p.ParseMessages(gt06Hex("78 78 0D 01 01 23 45 67 89 01 23 45 00 01 8C DD 0D 0A"))
+	assert.Empty(records)
+	assert.Empty(errs)
+	assert.Equal("123456789012345", p.Session.Device)
+	assert.Equal(gt06Hex("78 78 05 01 00 01 D9 DC 0D 0A"), p.Session.Reply())
+	assert.Empty(p.Session.Reply())
+
+	// The location from the protocol manual, locations are not acknowledged
+	records, errs = p.ParseMessages(location)
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("GT06", g.Protocol)
+		assert.Equal("Location", g.PacketType)
+		assert.Equal("123456789012345", g.Uniqid)
+		assert.Equal(int64(1314639976000), g.TS_Millis)
+		assert.InDelta(23.111668, g.ActualLat, 1e-6)
+		assert.InDelta(114.409285, g.ActualLng, 1e-6)
+		assert.Equal(15, g.NoOfSatellites)
+		assert.Equal(143, g.Direction)
+		assert.False(g.InvalidFix)
+	}
+	assert.Empty(p.Session.Reply())
+
+	// A heartbeat and an SOS alarm in one read, both acknowledged
+	heartbeat := gt06Packet("0A 13 46 04 03 0002 0005")
+	alarm := gt06Packet("25 16 0B081D112E10 CF 027AC7EB 0C465849 28 1C8F 09 01CC 00 287D 001FB8 42 02 04 0101 0006")
+	records, errs = p.ParseMessages(append(heartbeat, alarm...))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		assert.Equal("Heartbeat", records[0].PacketType)
+		assert.True(records[0].NoPosition)
+		assert.True(records[0].StatusIgnition)
+		assert.True(records[0].StatusBattery)
+		assert.Equal(66, records[0].BatteryPercent)
+		assert.Equal(3, records[0].GSMSignal)
+
+		assert.Equal("Alarm", records[1].PacketType)
+		assert.Equal(AlertSOS, records[1].Alert)
+		assert.Equal(40, records[1].Speed)
+		assert.InDelta(-114.409285, records[1].ActualLng, 1e-6)
+		assert.True(records[1].StatusIgnition)
+		assert.False(records[1].StatusBattery)
+	}
+	assert.Equal(append(gt06Packet("05 13 0005")[:10], gt06Packet("05 16 0006")...), p.Session.Reply())
+
+	// Corrupted packets
+	bad := gt06Hex("78 78 1F 12 0B 08 1D 11 2E 10 CF 02 7A C7 EB 0C 46 58 49 00 14 8F 01 CC 00 28 7D 00 1F B8 00 03 80 82 0D 0A")
+	records, errs = p.ParseMessages(append(bad, gt06Packet("05 99 0007")...))
+	assert.Empty(records)
+	if assert.Len(errs, 2) {
+		assert.True(errors.Is(errs[0], ReasonBadChecksum))
+		assert.Equal(&ParseError{Protocol: "GT06", PacketType: "0x99", Field: 3, Value: "\x99", Reason: ReasonUnknownPacket}, errs[1])
+	}
+}
+
+func TestGT06Split(t *testing.T) {
+	assert := assert.New(t)
+	login := gt06Hex("78 78 0D 01 01 23 45 67 89 01 23 45 00 01 8C DD 0D 0A")
+
+	split := FrameSplit(login)
+	if assert.NotNil(split) {
+		advance, token, err := split(append(login, 0x78), false)
+		assert.NoError(err)
+		assert.Equal(len(login), advance)
+		assert.Equal(login, token)
+
+		advance, token, err = split(login[:10], false)
+		assert.NoError(err)
+		assert.Equal(0, advance)
+		assert.Nil(token)
+
+		_, _, err = split([]byte("GTPL"), false)
+		assert.Equal(ReasonBadFrame, err)
+	}
+	assert.Nil(FrameSplit([]byte("GTPL $1")))
+}
@@ -0,0 +1,141 @@
+package gpsparser
+
+import (
+	"bytes"
+)
+
+// H02 is the text protocol of Sinotrack and many other cheap trackers, a close cousin of ZJ
+// *HQ,imei,V1,hhmmss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,course,ddmmyy,status[,mcc,mnc,lac,cell]#
+// *HQ,imei,LINK,hhmmss,gsm,satellites,battery,steps,rolls,ddmmyy,status#
+// *HQ,imei,HTBT#
+// Time and date are in UTC and speed is in knots
+// The status is 32 bits as 8 hex digits, active low, alarms are V1 frames with their alarm bits cleared
+type h02 struct{}
+
+func init() {
+	Register(h02{})
+}
+
+func (h02) Name() string {
+	return "H02"
+}
+
+func (h02) Detect(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte("*HQ"))
+}
+
+func (h02) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	// Multiple frames can arrive together, each one terminated by #
+	return parseFrames(s, records, errs, raw, '#', parseH02)
+}
+
+// The telemetry of the position (V1) and heartbeat (LINK) packets, both have the ignition in their status
+var (
+	h02PositionFields  = []field{fieldSpeed, fieldDir, fieldIgn}
+	h02HeartbeatFields = []field{fieldGSM, fieldSats, fieldBatPct, fieldIgn}
+)
+
+func (h02) telemetry(g *GPSParsed) []field {
+	switch g.PacketType {
+	case "V1":
+		return h02PositionFields
+	case "LINK":
+		return h02HeartbeatFields
+	}
+	return nil
+}
+
+// The bits of the H02 status we use, a cleared bit means the alarm is on
+const (
+	h02Vibration = 1 << 0
+	h02SOS       = 1 << 1
+	h02OverSpeed = 1 << 2
+	h02Ignition  = 1 << 10
+	h02SOS2      = 1 << 18 // Some devices use this one for SOS instead
+	h02PowerCut  = 1 << 19
+)
+
+// parseH02 parses a single H02 frame (without the trailing #) into g
+// Every frame carries the device ID, so the session is not needed
+func parseH02(_ *Session, g *GPSParsed, message []byte) error {
+	g.Raw = message
+	g.Protocol = "H02"
+
+	var buf [24][]byte
+	fields := splitFields(buf[:0], message)
+	if len(fields) < 3 {
+		return messageError(g, string(message), ReasonNotCSV)
+	}
+	g.Uniqid = internID(fields[1])
+
+	var err error
+	switch string(fields[2]) {
+	// Position, possibly followed by the cell the device is in
+	case "V1":
+		g.PacketType = "V1"
+		if len(fields) != 13 && len(fields) != 17 {
+			return messageError(g, string(message), ReasonFieldCount)
+		}
+		if err = v1Position(g, fields); err != nil {
+			return err
+		}
+		return h02Status(g, fields, 12)
+	// Heartbeat with the device status
+	case "LINK":
+		g.PacketType = "LINK"
+		if len(fields) != 11 {
+			return messageError(g, string(message), ReasonFieldCount)
+		}
+		if g.TS_Millis, err = timeField(g, fields, 9, 3); err != nil {
+			return err
+		}
+		g.NoPosition = true
+		if g.GSMSignal, err = intField(g, fields, 4, 0, 100); err != nil {
+			return err
+		}
+		if g.NoOfSatellites, err = intField(g, fields, 5, 0, 99); err != nil {
+			return err
+		}
+		if g.BatteryPercent, err = intField(g, fields, 6, 0, 100); err != nil {
+			return err
+		}
+		return h02Status(g, fields, 10)
+	// Keep alive, nothing in it
+	case "HTBT":
+		return errNoData
+	}
+	g.PacketType = unknownPacketType
+	return fieldError(g, 2, string(fields[2]), ReasonUnknownPacket)
+}
+
+// h02Status parses the status bitfield at field i, setting the ignition and the alert of g
+// When several alarms are on only the most important one is raised
+func h02Status(g *GPSParsed, fields [][]byte, i int) error {
+	if len(fields[i]) != 8 {
+		return fieldError(g, i, string(fields[i]), ReasonBadValue)
+	}
+	var status uint32
+	for j := 0; j < 8; j += 2 {
+		b, ok := hexByte(fields[i][j:])
+		if !ok {
+			return fieldError(g, i, string(fields[i]), ReasonBadValue)
+		}
+		status = status<<8 | uint32(b)
+	}
+
+	// Active low, flip it so that set bits are what is on
+	status = ^status
+	g.StatusIgnition = status&h02Ignition != 0
+	g.StatusBattery = status&h02PowerCut == 0
+	switch {
+	case status&(h02SOS|h02SOS2) != 0:
+		g.Alert = AlertSOS
+	case status&h02PowerCut != 0:
+		g.Alert = AlertBatteryDisconnected
+	case status&h02OverSpeed != 0:
+		g.Alert = AlertOverSpeed
+	case status&h02Vibration != 0:
+		g.Alert = AlertVibration
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package gpsparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseH02(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("*HQ,865205030330012,V1,062804,A,3106.3677,N,7710.9352,E,2.38,0.00,290518,FFFFFBFF#" +
+		"*HQ,865205030330012,V1,062804,A,3106.3677,N,7710.9352,E,2.38,0.00,290518,FFFFFBFD,404,45,12ab,34cd#" +
+		"*HQ,865205030330012,V1,062804,V,3106.3677,S,7710.9352,W,0,0,290518,FFF7FFFF#" +
+		"*HQ,865205030330012,LINK,112405,30,7,78,0,0,170220,FFFFFFFB#" +
+		"*HQ,865205030330012,HTBT#"))
+	assert.Empty(errs)
+	if assert.Len(records, 4) {
+		g := records[0]
+		assert.Equal("H02", g.Protocol)
+		assert.Equal("V1", g.PacketType)
+		assert.Equal("865205030330012", g.Uniqid)
+		assert.Equal(int64(1527575284000), g.TS_Millis)
+		assert.InDelta(31.106128, g.ActualLat, 1e-6)
+		assert.Equal(4, g.Speed)
+		assert.True(g.StatusIgnition)
+		assert.True(g.StatusBattery)
+		assert.Empty(g.Alert)
+
+		assert.Equal(AlertSOS, records[1].Alert)
+
+		assert.True(records[2].InvalidFix)
+		assert.False(records[2].StatusIgnition)
+		assert.False(records[2].StatusBattery)
+		assert.Equal(AlertBatteryDisconnected, records[2].Alert)
+
+		assert.Equal("LINK", records[3].PacketType)
+		assert.True(records[3].NoPosition)
+		assert.Equal(30, records[3].GSMSignal)
+		assert.Equal(7, records[3].NoOfSatellites)
+		assert.Equal(78, records[3].BatteryPercent)
+		assert.Equal(AlertOverSpeed, records[3].Alert)
+	}
+
+	records, errs = ParseMessages([]byte("*HQ,865205030330012,V1,062804,A,3106.3677,N,7710.9352,E,2.38,0.00,290518,FFFFFBFG#*HQ,865205030330012,NBR,062804#"))
+	assert.Empty(records)
+	if assert.Len(errs, 2) {
+		assert.Equal(&ParseError{Protocol: "H02", PacketType: "V1", Field: 12, Value: "FFFFFBFG", Reason: ReasonBadValue}, errs[0])
+		assert.Equal(&ParseError{Protocol: "H02", PacketType: "unknown", Field: 2, Value: "NBR", Reason: ReasonUnknownPacket}, errs[1])
+	}
+}
@@ -0,0 +1,288 @@
+package gpsparser
+
+import (
+	"bytes"
+	"math"
+)
+
+// NMEA 0183 is what GPS receivers speak natively, our cheaper trackers and test rigs just stream it over TCP
+// $GPRMC,hhmmss.ss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,course,ddmmyy,variation,E*hh
+// $GPGGA,hhmmss.ss,ddmm.mmmm,N,dddmm.mmmm,E,fix quality,satellites,hdop,altitude,M,geoid height,M,age,station*hh
+// The talker can be anything starting with G (GP for GPS, GN for multiple constellations, GL for GLONASS...)
+// Times are in UTC and speed is in knots
+// Sentences do not carry a device ID, the device is identified by its Session: the Fallback ID of the
+// listener it sends to, or its IP address when the listener has none
+type nmea struct{}
+
+func init() {
+	Register(nmea{})
+}
+
+func (nmea) Name() string {
+	return "NMEA"
+}
+
+func (nmea) Detect(raw []byte) bool {
+	// $ followed by a two letter talker and a three letter sentence type
+	return len(raw) >= 7 && raw[0] == '$' && raw[1] == 'G' && raw[6] == ','
+}
+
+func (nmea) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	// Every sentence is on its own line, ending in \r\n
+	return parseFrames(s, records, errs, raw, '\n', parseNMEA)
+}
+
+// The telemetry of an RMC sentence, with or without the GGA sentence of the same fix, and of a GGA sentence on its own
+var (
+	nmeaRMCFields    = []field{fieldSpeed, fieldDir}
+	nmeaRMCGGAFields = []field{fieldSpeed, fieldDir, fieldFix, fieldSats, fieldAlt}
+	nmeaGGAFields    = []field{fieldFix, fieldSats, fieldAlt}
+)
+
+func (nmea) telemetry(g *GPSParsed) []field {
+	switch g.PacketType {
+	case "RMC":
+		return nmeaRMCFields
+	case "RMC+GGA":
+		return nmeaRMCGGAFields
+	case "GGA":
+		return nmeaGGAFields
+	}
+	return nil
+}
+
+// nmeaState ties the RMC and GGA sentences of a fix together, receivers send both with the same time one after the other
+// Which one comes first depends on the receiver
+type nmeaState struct {
+	// Time of the last RMC sentence, GGA sentences only carry the time of day
+	rmc    int64
+	hasRMC bool
+
+	// The last GGA sentence, waiting for its RMC sentence
+	gga        int64 // Time of day in millis
+	hasGGA     bool
+	quality    int
+	satellites int
+	altitude   float64
+}
+
+const dayMillis = 24 * 60 * 60 * 1000
+
+// Midnight, to get the start of an RMC date from unixMillis
+var midnight = []byte("000000")
+
+// parseNMEA parses a single NMEA sentence (without the trailing newline) into g
+// RMC sentences are published with whatever the GGA sentence sent before them added to them,
+// GGA sentences sent after their RMC sentence are published on their own with the same timestamp
+// All other sentences are accepted but carry nothing to publish
+func parseNMEA(s *Session, g *GPSParsed, message []byte) error {
+	g.Raw = message
+	g.Protocol = "NMEA"
+
+	// The checksum is the XOR of everything between $ and *, as two hex digits
+	// A sentence cut in two by a stray newline leaves a line with no $ in front of the *
+	star := bytes.LastIndexByte(message, '*')
+	if message[0] != '$' || star < 1 || len(message)-star != 3 {
+		return messageError(g, string(message), ReasonBadChecksum)
+	}
+	checksum, ok := hexByte(message[star+1:])
+	if !ok {
+		return messageError(g, string(message), ReasonBadChecksum)
+	}
+	var sum byte
+	for _, c := range message[1:star] {
+		sum ^= c
+	}
+	if sum != checksum {
+		return messageError(g, string(message), ReasonBadChecksum)
+	}
+
+	var buf [24][]byte
+	fields := splitFields(buf[:0], message[:star])
+
+	if g.Uniqid = s.deviceID(); g.Uniqid == "" {
+		return messageError(g, string(message), ReasonNoDevice)
+	}
+
+	// The address is $, a two letter talker ID and the three letter sentence formatter
+	if len(fields[0]) != 6 {
+		return fieldError(g, 0, string(fields[0]), ReasonUnknownPacket)
+	}
+	switch string(fields[0][3:]) {
+	case "RMC":
+		g.PacketType = "RMC"
+		return parseRMC(s, g, fields)
+	case "GGA":
+		g.PacketType = "GGA"
+		return parseGGA(s, g, fields)
+	}
+	return errNoData
+}
+
+// parseRMC parses the recommended minimum sentence, which has the position, speed, course and date
+func parseRMC(s *Session, g *GPSParsed, fields [][]byte) error {
+	// NMEA 2.3 added the mode at field 12 and 4.1 the navigation status at field 13
+	if len(fields) < 12 || len(fields) > 14 {
+		return messageError(g, string(g.Raw), ReasonFieldCount)
+	}
+
+	clock, ok := nmeaTime(fields[1])
+	if !ok {
+		return fieldError(g, 1, string(fields[1]), ReasonBadTime)
+	}
+	date, ok := unixMillis(fields[9], midnight)
+	if !ok {
+		return fieldError(g, 9, string(fields[9]), ReasonBadTime)
+	}
+	g.TS_Millis = date + clock
+
+	var err error
+	if g.InvalidFix, err = fixField(g, fields, 2); err != nil {
+		return err
+	}
+
+	// Receivers without a fix leave the position empty
+	if len(fields[3]) == 0 && len(fields[5]) == 0 && g.InvalidFix {
+		g.NoPosition = true
+	} else {
+		if g.ActualLat, err = nmeaField(g, fields, 3); err != nil {
+			return err
+		}
+		if g.ActualLng, err = nmeaField(g, fields, 5); err != nil {
+			return err
+		}
+	}
+
+	// Speed and course are left empty when the receiver does not know them
+	if len(fields[7]) > 0 {
+		speed, err := floatField(g, fields, 7, 0, 1000)
+		if err != nil {
+			return err
+		}
+		g.Speed = knotsToKmph(speed)
+	}
+	if len(fields[8]) > 0 {
+		course, err := floatField(g, fields, 8, 0, 360)
+		if err != nil {
+			return err
+		}
+		g.Direction = int(math.Round(course))
+	}
+
+	state := nmeaSession(s)
+	state.rmc, state.hasRMC = g.TS_Millis, true
+
+	// The GGA sentence of this fix came first, it goes out with this one
+	if state.hasGGA && state.gga == clock {
+		g.PacketType = "RMC+GGA"
+		g.FixQuality, g.NoOfSatellites, g.Altitude = state.quality, state.satellites, state.altitude
+		g.InvalidFix = g.InvalidFix || state.quality == 0
+		state.hasGGA, state.hasRMC = false, false
+	}
+	return nil
+}
+
+// parseGGA parses the fix data sentence, which has the fix quality, number of satellites and altitude
+// Its position is the same as that of the RMC sentence and is not used
+func parseGGA(s *Session, g *GPSParsed, fields [][]byte) error {
+	if len(fields) != 15 {
+		return messageError(g, string(g.Raw), ReasonFieldCount)
+	}
+
+	clock, ok := nmeaTime(fields[1])
+	if !ok {
+		return fieldError(g, 1, string(fields[1]), ReasonBadTime)
+	}
+
+	// 0 is no fix, 1 a GPS fix, 2 a differential fix and so on
+	quality, err := intField(g, fields, 6, 0, 9)
+	if err != nil {
+		return err
+	}
+	// Satellites and altitude are left empty without a fix
+	var satellites int
+	if len(fields[7]) > 0 {
+		if satellites, err = intField(g, fields, 7, 0, 99); err != nil {
+			return err
+		}
+	}
+	var altitude float64
+	if len(fields[9]) > 0 {
+		if altitude, err = floatField(g, fields, 9, -1000, 100000); err != nil {
+			return err
+		}
+	}
+
+	state := nmeaSession(s)
+
+	// The RMC sentence of this fix has already been published, publish the rest of it at the same time
+	if state.hasRMC && state.rmc%dayMillis == clock {
+		g.TS_Millis = state.rmc
+		g.NoPosition = true
+		g.FixQuality, g.NoOfSatellites, g.Altitude = quality, satellites, altitude
+		g.InvalidFix = quality == 0
+		state.hasRMC = false
+		return nil
+	}
+
+	// Otherwise keep it for the RMC sentence that comes next
+	state.gga, state.hasGGA = clock, true
+	state.quality, state.satellites, state.altitude = quality, satellites, altitude
+	return errNoData
+}
+
+// nmeaSession returns the NMEA state kept in s, creating it the first time
+func nmeaSession(s *Session) *nmeaState {
+	state, ok := s.state.(*nmeaState)
+	if !ok {
+		state = new(nmeaState)
+		s.state = state
+	}
+	return state
+}
+
+// nmeaTime parses a hhmmss or hhmmss.sss time of day into millis since midnight
+func nmeaTime(b []byte) (int64, bool) {
+	if len(b) < 6 || (len(b) > 6 && b[6] != '.') {
+		return 0, false
+	}
+	hour, ok := twoDigits(b)
+	minute, ok2 := twoDigits(b[2:])
+	second, ok3 := twoDigits(b[4:])
+	if !ok || !ok2 || !ok3 || hour > 23 || minute > 59 || second > 59 {
+		return 0, false
+	}
+	ms := int64(((hour*60+minute)*60 + second) * 1000)
+
+	// Fractions of a second, anything past millis is ignored
+	if len(b) > 7 {
+		scale := int64(100)
+		for _, c := range b[7:] {
+			if c < '0' || c > '9' {
+				return 0, false
+			}
+			ms += int64(c-'0') * scale
+			scale /= 10
+		}
+	}
+	return ms, true
+}
+
+// hexByte parses two hex digits
+func hexByte(b []byte) (byte, bool) {
+	var n byte
+	for _, c := range b[:2] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | c
+	}
+	return n, true
+}
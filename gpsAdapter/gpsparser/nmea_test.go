@@ -0,0 +1,110 @@
+package gpsparser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testGGA = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n"
+	testRMC = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n"
+)
+
+func TestParseNMEA(t *testing.T) {
+	assert := assert.New(t)
+	p := NewParser("10.1.2.3:5555")
+
+	// GGA first, it is held back until its RMC sentence arrives
+	records, errs := p.ParseMessages([]byte(testGGA))
+	assert.Empty(errs)
+	assert.Empty(records)
+
+	records, errs = p.ParseMessages([]byte(testRMC))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("NMEA", g.Protocol)
+		assert.Equal("RMC+GGA", g.PacketType)
+		assert.Equal("10.1.2.3", g.Uniqid)
+		assert.Equal(int64(764426119000), g.TS_Millis)
+		assert.InDelta(48.1173, g.ActualLat, 1e-6)
+		assert.InDelta(11.516667, g.ActualLng, 1e-6)
+		assert.Equal(41, g.Speed)
+		assert.Equal(84, g.Direction)
+		assert.Equal(1, g.FixQuality)
+		assert.Equal(8, g.NoOfSatellites)
+		assert.Equal(545.4, g.Altitude)
+		assert.False(g.InvalidFix)
+	}
+
+	// RMC first, the GGA sentence is published on its own at the same time
+	records, errs = p.ParseMessages([]byte(testRMC + testGGA))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		assert.Equal("RMC", records[0].PacketType)
+		assert.Equal("GGA", records[1].PacketType)
+		assert.Equal(records[0].TS_Millis, records[1].TS_Millis)
+		assert.True(records[1].NoPosition)
+		assert.Equal(8, records[1].NoOfSatellites)
+	}
+
+	// A listener with a device ID names the device instead of its IP
+	named := NewParser("10.1.2.3:5555")
+	named.Session.Fallback = "boat-7"
+	records, errs = named.ParseMessages([]byte(testRMC))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		assert.Equal("boat-7", records[0].Uniqid)
+	}
+
+	// Other sentences are ignored, and receivers without a fix send no position
+	records, errs = p.ParseMessages([]byte("$GPGSV,2,1,08,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45*75\r\n$GNRMC,123520.50,V,,,,,,,230394,,,N*6E\r\n"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		assert.Equal(int64(764426120500), records[0].TS_Millis)
+		assert.True(records[0].InvalidFix)
+		assert.True(records[0].NoPosition)
+	}
+
+	// Bad checksums, and sentences from a connection nobody knows
+	records, errs = p.ParseMessages([]byte("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6B\r\n$GPRMC,123519,A*\r\n"))
+	assert.Empty(records)
+	if assert.Len(errs, 2) {
+		assert.True(errors.Is(errs[0], ReasonBadChecksum))
+		assert.True(errors.Is(errs[1], ReasonBadChecksum))
+	}
+	// A sentence cut in two by a stray newline, neither half is a sentence
+	records, errs = p.ParseMessages([]byte("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W\n*6A\r\n"))
+	assert.Empty(records)
+	if assert.Len(errs, 2) {
+		assert.True(errors.Is(errs[0], ReasonBadChecksum))
+		assert.True(errors.Is(errs[1], ReasonBadChecksum))
+	}
+
+	// A valid checksum does not make a sentence, here on a listener that only speaks NMEA
+	p.Protocol = Lookup("NMEA")
+	records, errs = p.ParseMessages([]byte("$*00\r\n"))
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ReasonUnknownPacket))
+	}
+	_, errs = ParseMessages([]byte(testRMC))
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ReasonNoDevice))
+	}
+}
+
+func TestNmeaTime(t *testing.T) {
+	assert := assert.New(t)
+	for input, expected := range map[string]int64{"000000": 0, "123519": 45319000, "123519.5": 45319500, "235959.999": 86399999} {
+		ms, ok := nmeaTime([]byte(input))
+		assert.True(ok, input)
+		assert.Equal(expected, ms, input)
+	}
+	for _, input := range []string{"", "12351", "245959", "123519,5", "123519.x"} {
+		_, ok := nmeaTime([]byte(input))
+		assert.False(ok, input)
+	}
+}
@@ -0,0 +1,193 @@
+package gpsparser
+
+import (
+	"bytes"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OsmAnd is the HTTP protocol of the OsmAnd and Traccar Client phone apps, also spoken by some modern trackers
+// Every position is its own request, with a query string (or form body) like
+// id=359586015829802&lat=22.574448&lon=113.905478&timestamp=1527575284&speed=2.3&bearing=90&altitude=12&batt=87
+// The timestamp is in unix seconds, unix millis or RFC 3339, and speed is in knots
+type osmand struct{}
+
+func init() {
+	Register(osmand{})
+}
+
+func (osmand) Name() string {
+	return "OsmAnd"
+}
+
+func (osmand) Detect(raw []byte) bool {
+	for _, key := range [...]string{"id=", "deviceid="} {
+		if bytes.HasPrefix(raw, []byte(key)) || bytes.Contains(raw, []byte("&"+key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (osmand) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	records = append(records, GPSParsed{})
+	if err := parseOsmAnd(&records[len(records)-1], raw); err != nil {
+		records = records[:len(records)-1]
+		errs = append(errs, err)
+	}
+	return records, errs
+}
+
+// The telemetry of a position report, followed by whatever else the device sent
+var osmandReportFields = []field{fieldSpeed, fieldDir, fieldAlt, fieldIO}
+
+func (osmand) telemetry(g *GPSParsed) []field {
+	if g.PacketType == "report" {
+		return osmandReportFields
+	}
+	return nil
+}
+
+// parseOsmAnd parses a single position report into g
+// As parameters have no position, errors point at the whole report with the offending parameter as the value
+func parseOsmAnd(g *GPSParsed, raw []byte) error {
+	g.Raw = raw
+	g.Protocol = "OsmAnd"
+	g.PacketType = "report"
+
+	query, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return messageError(g, string(raw), ReasonBadValue)
+	}
+	get := func(keys ...string) (string, string) {
+		for _, key := range keys {
+			if v := query.Get(key); v != "" {
+				return key, v
+			}
+		}
+		return "", ""
+	}
+
+	if _, g.Uniqid = get("id", "deviceid"); g.Uniqid == "" {
+		return messageError(g, string(raw), ReasonNoDevice)
+	}
+
+	// Without a timestamp the position is taken to be from now
+	g.TS_Millis = time.Now().UnixNano() / int64(time.Millisecond)
+	if _, v := get("timestamp"); v != "" {
+		if g.TS_Millis, err = osmandTime(v); err != nil {
+			return messageError(g, "timestamp="+v, ReasonBadTime)
+		}
+	}
+
+	// The position comes as lat and lon, or together as location=lat,lon
+	lat, lng := query.Get("lat"), query.Get("lon")
+	if location := query.Get("location"); location != "" {
+		if i := strings.IndexByte(location, ','); i >= 0 {
+			lat, lng = location[:i], location[i+1:]
+		}
+	}
+	if lat == "" || lng == "" {
+		return messageError(g, string(raw), ReasonBadCoordinate)
+	}
+	if g.ActualLat, err = strconv.ParseFloat(lat, 64); err != nil || g.ActualLat < -90 || g.ActualLat > 90 {
+		return messageError(g, "lat="+lat, ReasonBadCoordinate)
+	}
+	if g.ActualLng, err = strconv.ParseFloat(lng, 64); err != nil || g.ActualLng < -180 || g.ActualLng > 180 {
+		return messageError(g, "lon="+lng, ReasonBadCoordinate)
+	}
+	if _, v := get("valid"); v != "" {
+		valid, err := strconv.ParseBool(v)
+		if err != nil {
+			return messageError(g, "valid="+v, ReasonNotBool)
+		}
+		g.InvalidFix = !valid
+	}
+
+	// Optional numbers, the first one in range of each is used
+	number := func(min float64, max float64, keys ...string) (float64, error) {
+		key, v := get(keys...)
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !finite(f) {
+			return 0, messageError(g, key+"="+v, ReasonNotNumber)
+		}
+		if f < min || f > max {
+			return 0, messageError(g, key+"="+v, ReasonOutOfRange)
+		}
+		return f, nil
+	}
+	speed, err := number(0, 1000, "speed")
+	if err != nil {
+		return err
+	}
+	g.Speed = knotsToKmph(speed)
+	direction, err := number(0, 360, "bearing", "heading")
+	if err != nil {
+		return err
+	}
+	g.Direction = int(math.Round(direction))
+	if g.Altitude, err = number(-1000, 100000, "altitude"); err != nil {
+		return err
+	}
+
+	// Everything else is published as it is, when the device sends it
+	g.IO = make(map[string]interface{})
+	for _, extra := range [...]struct {
+		key  string
+		name string
+		max  float64
+	}{{"batt", "batPct", 100}, {"accuracy", "accuracy", 1e6}, {"hdop", "hdop", 100}} {
+		if query.Get(extra.key) == "" {
+			continue
+		}
+		v, err := number(0, extra.max, extra.key)
+		if err != nil {
+			return err
+		}
+		g.IO[extra.name] = v
+	}
+
+	if _, v := get("alarm"); v != "" {
+		switch v {
+		case "sos":
+			g.Alert = AlertSOS
+		case "powerCut":
+			g.Alert = AlertBatteryDisconnected
+		case "lowBattery":
+			g.Alert = AlertBatteryLow
+		case "overspeed":
+			g.Alert = AlertOverSpeed
+		case "vibration":
+			g.Alert = AlertVibration
+		case "geofenceEnter":
+			g.Alert = AlertGeofenceEnter
+		case "geofenceExit":
+			g.Alert = AlertGeofenceExit
+		default:
+			return messageError(g, "alarm="+v, ReasonBadValue)
+		}
+	}
+	return nil
+}
+
+// osmandTime parses a timestamp in unix seconds, unix millis or RFC 3339 into unix millis
+func osmandTime(v string) (int64, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// Millis have more digits than seconds will for a long time
+		if n < 1e11 {
+			n *= 1000
+		}
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
@@ -0,0 +1,55 @@
+package gpsparser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOsmAnd(t *testing.T) {
+	assert := assert.New(t)
+
+	records, errs := ParseMessages([]byte("id=359586015829802&lat=22.574448&lon=-113.905478&timestamp=1527575284&speed=2.3&bearing=90.4&altitude=12.5&batt=87&alarm=sos"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("OsmAnd", g.Protocol)
+		assert.Equal("report", g.PacketType)
+		assert.Equal("359586015829802", g.Uniqid)
+		assert.Equal(int64(1527575284000), g.TS_Millis)
+		assert.Equal(22.574448, g.ActualLat)
+		assert.Equal(-113.905478, g.ActualLng)
+		assert.Equal(4, g.Speed)
+		assert.Equal(90, g.Direction)
+		assert.Equal(12.5, g.Altitude)
+		assert.Equal(AlertSOS, g.Alert)
+		assert.Equal(map[string]interface{}{"batPct": 87.0}, g.IO)
+	}
+
+	// Traccar Client style, with the location in one parameter and the time in RFC 3339
+	records, errs = ParseMessages([]byte("deviceid=phone1&location=18.7%2C80.06&timestamp=2018-05-29T06%3A28%3A04Z&valid=false&accuracy=25"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("phone1", g.Uniqid)
+		assert.Equal(int64(1527575284000), g.TS_Millis)
+		assert.Equal(18.7, g.ActualLat)
+		assert.True(g.InvalidFix)
+		assert.Equal(map[string]interface{}{"accuracy": 25.0}, g.IO)
+	}
+
+	for query, reason := range map[string]Reason{
+		"id=1&lat=91&lon=0":              ReasonBadCoordinate,
+		"id=1&lat=1":                     ReasonBadCoordinate,
+		"id=1&lat=1&lon=1&timestamp=now": ReasonBadTime,
+		"id=1&lat=1&lon=1&speed=fast":    ReasonNotNumber,
+		"id=1&lat=1&lon=1&batt=101":      ReasonOutOfRange,
+		"id=1&lat=1&lon=1&alarm=fire":    ReasonBadValue,
+	} {
+		_, errs := ParseMessages([]byte(query))
+		if assert.Len(errs, 1, query) {
+			assert.True(errors.Is(errs[0], reason), query)
+		}
+	}
+}
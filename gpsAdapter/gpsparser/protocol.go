@@ -0,0 +1,99 @@
+package gpsparser
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+)
+
+// Protocol is implemented by every tracker family that gpsparser understands
+// Each protocol lives in its own file and registers itself from an init function
+type Protocol interface {
+	// Name of the protocol, this is also what ends up in GPSParsed.Protocol
+	Name() string
+	// Detect reports whether raw looks like data sent in this protocol
+	Detect(raw []byte) bool
+	// Parse appends a record for every message in raw that could be parsed to records,
+	// and a *ParseError for every one that could not to errs
+	// s holds what is known about the connection raw came from, it is never nil
+	// Records may share memory with raw
+	Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error)
+}
+
+// Framer is implemented by protocols that frame their messages themselves, binary protocols mostly
+// Text protocols end every message with a terminator and leave framing to the caller
+type Framer interface {
+	// Split is a bufio.SplitFunc cutting the next message off data, which starts with a message in this protocol
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+}
+
+// telemeter is implemented by protocols whose records have telemetry besides the position, the fix validity and the alert
+// Every protocol knows its own packet types, so the encoder does not have to
+type telemeter interface {
+	// telemetry returns the fields published for g, a record parsed by this protocol, in the order they are published
+	telemetry(g *GPSParsed) []field
+}
+
+// All registered protocols, in the order they were registered
+// Detection tries them in this order
+var registry = struct {
+	sync.RWMutex
+	protocols []Protocol
+}{}
+
+// Register makes a protocol available for detection and lookup
+// It panics if a protocol with the same name is already registered
+func Register(p Protocol) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, existing := range registry.protocols {
+		if existing.Name() == p.Name() {
+			panic(fmt.Sprintf("gpsparser: protocol %s registered twice", p.Name()))
+		}
+	}
+	registry.protocols = append(registry.protocols, p)
+}
+
+// Lookup returns the registered protocol with the given name, or nil if there is none
+func Lookup(name string) Protocol {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, p := range registry.protocols {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Protocols returns the names of all registered protocols
+func Protocols() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]string, len(registry.protocols))
+	for i, p := range registry.protocols {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+// Detect returns the first registered protocol that recognises raw, or nil if none of them do
+func Detect(raw []byte) Protocol {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, p := range registry.protocols {
+		if p.Detect(raw) {
+			return p
+		}
+	}
+	return nil
+}
+
+// FrameSplit returns the Split function of the protocol data is in, if that protocol frames its own messages
+// It returns nil for text protocols and for data that no protocol recognises
+func FrameSplit(data []byte) bufio.SplitFunc {
+	if f, ok := Detect(data).(Framer); ok {
+		return f.Split
+	}
+	return nil
+}
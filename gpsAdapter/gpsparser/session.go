@@ -0,0 +1,56 @@
+package gpsparser
+
+import (
+	"net"
+)
+
+// Session is what is known about one connection, carried over from one message to the next
+// Not every protocol sends the device ID in every message (NMEA never sends one at all), and some
+// spread a single fix over several messages, those protocols keep what they need in here
+type Session struct {
+	// Device is the ID of the device on the other end, once one of its messages has told us
+	Device string
+	// Fallback is the device ID for messages that never carry one (NMEA), as set up for the listener
+	Fallback string
+	// Remote is the host the connection comes from, it is the device ID of last resort
+	// Devices behind the same NAT or on a dynamic IP get mixed up or renamed with it, set Fallback instead
+	Remote string
+	// Conn names the connection for logs and routing, it is passed on in every Envelope
+	Conn string
+
+	// Protocol specific state, only ever used by the protocol that put it there
+	state interface{}
+
+	// What has to be written back to the device, see Reply
+	reply []byte
+}
+
+// Reply returns what has to be written back to the device for the messages parsed since the last call
+// (acknowledgements mostly), and forgets it. The returned slice is only valid until the next message is parsed
+func (s *Session) Reply() []byte {
+	reply := s.reply
+	s.reply = s.reply[:0]
+	return reply
+}
+
+// deviceID returns the ID to use for messages that do not carry one, or "" if the device is not known
+func (s *Session) deviceID() string {
+	if s.Device != "" {
+		return s.Device
+	}
+	if s.Fallback != "" {
+		return s.Fallback
+	}
+	return s.Remote
+}
+
+// NewParser returns a Parser for the messages of a single connection from remote (host:port)
+// Its Session lives as long as the Parser, so use one Parser per connection
+func NewParser(remote string) *Parser {
+	p := new(Parser)
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	p.Session.Remote = remote
+	return p
+}
@@ -0,0 +1,289 @@
+package gpsparser
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync"
+)
+
+// Teltonika is the binary protocol of the Teltonika FMB family, we decode Codec 8 and Codec 8 Extended
+// The device first sends its IMEI (two bytes of length and the IMEI in ASCII) and waits for 0x01 before sending data
+// AVL packets are four zero bytes, the length of the data, the data and a CRC-16/IBM of the data
+// The data is the codec ID, the number of records, the records, and the number of records again
+// Every AVL packet has to be acknowledged with its number of records as four bytes, the device sends it again otherwise
+type teltonika struct{}
+
+func init() {
+	Register(teltonika{})
+}
+
+func (teltonika) Name() string {
+	return "Teltonika"
+}
+
+func (teltonika) Detect(raw []byte) bool {
+	// The IMEI handshake
+	if len(raw) >= 3 && raw[0] == 0 && raw[1] > 0 && raw[2] >= '0' && raw[2] <= '9' {
+		return true
+	}
+	// AVL packets start with four zero bytes
+	return len(raw) >= 4 && raw[0] == 0 && raw[1] == 0 && raw[2] == 0 && raw[3] == 0
+}
+
+// Split cuts the next handshake or AVL packet off data using the length in its header
+func (teltonika) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	size, err := teltonikaSize(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size == 0 || len(data) < size {
+		if atEOF && len(data) > 0 {
+			return 0, nil, ReasonBadFrame
+		}
+		return 0, nil, nil
+	}
+	return size, data[:size], nil
+}
+
+func (teltonika) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	for len(raw) > 0 {
+		// A packet that does not fit what is left is cut short, the rest is parsed as one to report it
+		size, err := teltonikaSize(raw)
+		if err != nil || size == 0 || size > len(raw) {
+			size = len(raw)
+		}
+		packet := raw[:size]
+		raw = raw[size:]
+
+		if records, err = parseTeltonika(s, records, packet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return records, errs
+}
+
+// The telemetry of an AVL record, followed by its IO elements
+var teltonikaAVLFields = []field{fieldSpeed, fieldDir, fieldSats, fieldAlt, fieldIO}
+
+func (teltonika) telemetry(g *GPSParsed) []field {
+	if g.PacketType == "AVL" {
+		return teltonikaAVLFields
+	}
+	return nil
+}
+
+// teltonikaSize returns the size of the packet at the start of data from its header, 0 if the header is not all there yet
+func teltonikaSize(data []byte) (int, error) {
+	switch {
+	case len(data) < 2:
+		if len(data) > 0 && data[0] != 0 {
+			return 0, ReasonBadFrame
+		}
+		return 0, nil
+	case data[0] != 0:
+		return 0, ReasonBadFrame
+	case data[1] != 0:
+		// The IMEI handshake, IMEIs are much shorter than 256 bytes
+		return 2 + int(data[1]), nil
+	case len(data) < 8:
+		return 0, nil
+	case data[2] != 0 || data[3] != 0:
+		return 0, ReasonBadFrame
+	}
+	// Preamble, length and CRC are not counted in the length
+	return 12 + int(binary.BigEndian.Uint32(data[4:])), nil
+}
+
+// parseTeltonika handles a single handshake or AVL packet, appending a record to records for every AVL record in it
+// Both are acknowledged through the session, a packet with an error in it is not acknowledged at all
+func parseTeltonika(s *Session, records []GPSParsed, packet []byte) ([]GPSParsed, error) {
+	g := GPSParsed{Raw: packet, Protocol: "Teltonika"}
+	if len(packet) < 2 {
+		return records, messageError(&g, string(packet), ReasonBadFrame)
+	}
+
+	// The IMEI handshake
+	if packet[1] != 0 {
+		g.PacketType = "Login"
+		imei := packet[2:]
+		if _, ok := atoi(imei); !ok || len(imei) != int(packet[1]) {
+			return records, fieldError(&g, 2, string(imei), ReasonNotNumber)
+		}
+		s.Device = internID(imei)
+		s.reply = append(s.reply, 0x01)
+		return records, nil
+	}
+
+	g.PacketType = "AVL"
+	if len(packet) < 15 {
+		return records, messageError(&g, string(packet), ReasonBadFrame)
+	}
+	if g.Uniqid = s.Device; g.Uniqid == "" {
+		return records, messageError(&g, string(packet), ReasonNoDevice)
+	}
+	end := len(packet) - 4
+	data := packet[8:end]
+	if uint32(crc16IBM(data)) != binary.BigEndian.Uint32(packet[end:]) {
+		return records, messageError(&g, string(packet), ReasonBadChecksum)
+	}
+
+	// Codec 8 Extended has two byte IO IDs and counts, and variable length IO elements
+	codec := data[0]
+	if codec != 0x08 && codec != 0x8E {
+		return records, fieldError(&g, 8, string(data[:1]), ReasonUnknownPacket)
+	}
+	count := data[1]
+	if data[len(data)-1] != count {
+		return records, fieldError(&g, end-1, string(data[len(data)-1:]), ReasonBadFrame)
+	}
+
+	names := currentIONames()
+	r := avlReader{b: data[:len(data)-1], off: 2}
+	start := len(records)
+	for i := 0; i < int(count); i++ {
+		records = append(records, g)
+		readAVLRecord(&r, &records[len(records)-1], codec == 0x8E, names)
+	}
+	if r.short || r.off != len(r.b) {
+		return records[:start], messageError(&g, string(packet), ReasonBadFrame)
+	}
+
+	s.reply = append(s.reply, 0, 0, 0, count)
+	return records, nil
+}
+
+// readAVLRecord reads a single AVL record off r into g
+func readAVLRecord(r *avlReader, g *GPSParsed, extended bool, names map[int]string) {
+	g.TS_Millis = int64(r.uint(8))
+	// Priority 0 is low, 1 high and 2 panic
+	if r.uint(1) == 2 {
+		g.Alert = AlertSOS
+	}
+
+	// Coordinates are in 1/10000000ths of a degree, negative for south and west
+	g.ActualLng = float64(int32(r.uint(4))) / 1e7
+	g.ActualLat = float64(int32(r.uint(4))) / 1e7
+	g.Altitude = float64(int16(r.uint(2)))
+	g.Direction = int(r.uint(2))
+	g.NoOfSatellites = int(r.uint(1))
+	g.Speed = int(r.uint(2))
+	// Without a fix the device sends its last position and no satellites
+	g.InvalidFix = g.NoOfSatellites == 0
+
+	// The IO element that caused the record and the number of IO elements, both of which we do not need
+	idSize := 1
+	if extended {
+		idSize = 2
+	}
+	r.uint(idSize)
+	r.uint(idSize)
+
+	// IO elements are grouped by the size of their value
+	g.IO = make(map[string]interface{})
+	for _, size := range [...]int{1, 2, 4, 8} {
+		n := int(r.uint(idSize))
+		for j := 0; j < n && !r.short; j++ {
+			name := ioName(names, int(r.uint(idSize)))
+			g.IO[name] = int64(r.uint(size))
+		}
+	}
+	if extended {
+		n := int(r.uint(2))
+		for j := 0; j < n && !r.short; j++ {
+			name := ioName(names, int(r.uint(2)))
+			g.IO[name] = hex.EncodeToString(r.bytes(int(r.uint(2))))
+		}
+	}
+}
+
+// avlReader reads big endian values off an AVL packet
+// Reading past the end returns zeros and sets short, so records can be read without checking every field
+type avlReader struct {
+	b     []byte
+	off   int
+	short bool
+}
+
+func (r *avlReader) uint(n int) uint64 {
+	var v uint64
+	for _, c := range r.bytes(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (r *avlReader) bytes(n int) []byte {
+	if n > len(r.b)-r.off {
+		r.short = true
+		r.off = len(r.b)
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// crc16IBM computes the CRC-16/IBM of b, as used by Teltonika
+func crc16IBM(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// The telemetry keys of the Teltonika IO elements gpsparser knows about
+var defaultIONames = map[int]string{
+	1:   "din1",
+	16:  "odo",
+	21:  "gsm",
+	66:  "extVolt",
+	67:  "batVolt",
+	69:  "gnssStatus",
+	239: "ign",
+	240: "movement",
+}
+
+// The telemetry keys of the Teltonika IO elements in use, set with SetIONames
+var ioNames = struct {
+	sync.RWMutex
+	names map[int]string
+}{names: defaultIONames}
+
+// SetIONames names Teltonika IO element IDs in telemetry, on top of or instead of the names gpsparser already has
+// Every call starts over from the names gpsparser has, so names given to an earlier call are forgotten
+// IO elements without a name are published as io<ID>, e.g. io200
+func SetIONames(names map[int]string) {
+	merged := make(map[int]string)
+	for id, name := range defaultIONames {
+		merged[id] = name
+	}
+	for id, name := range names {
+		merged[id] = name
+	}
+	ioNames.Lock()
+	ioNames.names = merged
+	ioNames.Unlock()
+}
+
+// currentIONames returns the IO names in use, the map is never changed once it is in use
+func currentIONames() map[int]string {
+	ioNames.RLock()
+	defer ioNames.RUnlock()
+	return ioNames.names
+}
+
+func ioName(names map[int]string, id int) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return "io" + strconv.Itoa(id)
+}
@@ -0,0 +1,79 @@
+package gpsparser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTeltonika(t *testing.T) {
+	assert := assert.New(t)
+	p := NewParser("10.1.2.3:5555")
+
+	// The Codec 8 example from the protocol documentation
+	codec8 := gt06Hex("000000000000003608010000016B40D8EA30010000000000000000000000000000000105021503010101425E0F01F10000601A014E0000000000000000010000C7CF")
+
+	// Nothing is accepted before the IMEI handshake
+	records, errs := p.ParseMessages(codec8)
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ReasonNoDevice))
+	}
+	assert.Empty(p.Session.Reply())
+
+	records, errs = p.ParseMessages(gt06Hex("000F333536333037303432343431303133"))
+	assert.Empty(records)
+	assert.Empty(errs)
+	assert.Equal("356307042441013", p.Session.Device)
+	assert.Equal([]byte{0x01}, p.Session.Reply())
+
+	records, errs = p.ParseMessages(codec8)
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("Teltonika", g.Protocol)
+		assert.Equal("AVL", g.PacketType)
+		assert.Equal("356307042441013", g.Uniqid)
+		assert.Equal(int64(1560161086000), g.TS_Millis)
+		assert.True(g.InvalidFix)
+		assert.Equal(map[string]interface{}{"din1": int64(1), "gsm": int64(3), "extVolt": int64(24079), "io241": int64(24602), "io78": int64(0)}, g.IO)
+	}
+	assert.Equal([]byte{0, 0, 0, 1}, p.Session.Reply())
+
+	// The Codec 8 Extended example from the protocol documentation, with IO names of our own
+	defer func(names map[int]string) { ioNames.names = names }(currentIONames())
+	SetIONames(map[int]string{11: "iccid1", 14: "iccid2"})
+	records, errs = p.ParseMessages(gt06Hex("000000000000004A8E010000016B412CEE000100000000000000000000000000000000010005000100010100010011001D00010010015E2C880002000B000000003544C87A000E000000001DD7E06A00000100002994"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		assert.Equal(int64(1560166592000), records[0].TS_Millis)
+		assert.Equal(map[string]interface{}{"din1": int64(1), "io17": int64(29), "odo": int64(22949000), "iccid1": int64(893700218), "iccid2": int64(500686954)}, records[0].IO)
+	}
+	assert.Equal([]byte{0, 0, 0, 1}, p.Session.Reply())
+
+	// Names are set afresh every time, names that are not given anymore are forgotten
+	SetIONames(map[int]string{11: "iccid"})
+	assert.Equal("iccid", currentIONames()[11])
+	assert.NotContains(currentIONames(), 14)
+	assert.Equal("din1", currentIONames()[1])
+
+	// A corrupted packet is not acknowledged, so the device sends it again
+	codec8[20] ^= 0xFF
+	records, errs = p.ParseMessages(codec8)
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.True(errors.Is(errs[0], ReasonBadChecksum))
+	}
+	assert.Empty(p.Session.Reply())
+
+	// A lone byte on a Teltonika listener, or one left over after a handshake, is a frame cut short
+	p.Protocol = Lookup("Teltonika")
+	for _, raw := range [][]byte{{0x00}, gt06Hex("000F33353633303730343234343130313300")} {
+		records, errs = p.ParseMessages(raw)
+		assert.Empty(records)
+		if assert.Len(errs, 1) {
+			assert.True(errors.Is(errs[0], ReasonBadFrame))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package gpsparser
+
+import (
+	"bytes"
+	"math"
+)
+
+// TK103 is the text protocol of the TK103 clones (Coban and friends), every frame ends in ;
+// ##,imei:359586015829802,A; is the login, to be answered with LOAD
+// 359586015829802; is the heartbeat, to be answered with ON
+// imei:359586015829802,tracker,yymmddhhmm,phone,F,hhmmss.sss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,course; is a position
+// The keyword (tracker) says why the position was sent, the date is in local time but the time is in UTC, speed is in knots
+type tk103 struct{}
+
+func init() {
+	Register(tk103{})
+}
+
+func (tk103) Name() string {
+	return "TK103"
+}
+
+func (tk103) Detect(raw []byte) bool {
+	if bytes.HasPrefix(raw, []byte("##,imei:")) || bytes.HasPrefix(raw, []byte("imei:")) {
+		return true
+	}
+	// The heartbeat is nothing but the IMEI
+	i := 0
+	for i < len(raw) && raw[i] >= '0' && raw[i] <= '9' {
+		i++
+	}
+	return i >= 10 && i < len(raw) && raw[i] == ';'
+}
+
+// Split cuts the next frame off data, frames end in ; and the login contains #, so the usual text framing does not work
+func (tk103) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, ';'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (tk103) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	return parseFrames(s, records, errs, raw, ';', parseTK103)
+}
+
+// The telemetry of the position report (tracker, and the alarms sent in its place)
+var tk103PositionFields = []field{fieldSpeed, fieldDir}
+
+func (tk103) telemetry(g *GPSParsed) []field {
+	if g.PacketType == "tracker" {
+		return tk103PositionFields
+	}
+	return nil
+}
+
+// parseTK103 parses a single TK103 frame (without the trailing ;) into g
+// Logins and heartbeats are answered through the session
+func parseTK103(s *Session, g *GPSParsed, message []byte) error {
+	g.Raw = message
+	g.Protocol = "TK103"
+
+	// Login
+	if bytes.HasPrefix(message, []byte("##,imei:")) {
+		g.PacketType = "Login"
+		var buf [4][]byte
+		fields := splitFields(buf[:0], message[len("##,imei:"):])
+		if _, ok := atoi(fields[0]); !ok {
+			return fieldError(g, 1, string(fields[0]), ReasonNotNumber)
+		}
+		s.Device = internID(fields[0])
+		s.reply = append(s.reply, "LOAD"...)
+		return errNoData
+	}
+
+	// Heartbeat
+	if _, ok := atoi(message); ok {
+		s.Device = internID(message)
+		s.reply = append(s.reply, "ON"...)
+		return errNoData
+	}
+
+	var buf [24][]byte
+	fields := splitFields(buf[:0], message)
+	if len(fields) == 1 {
+		return messageError(g, string(message), ReasonNotCSV)
+	}
+	if !bytes.HasPrefix(fields[0], []byte("imei:")) {
+		return fieldError(g, 0, string(fields[0]), ReasonBadHeader)
+	}
+	g.PacketType = "tracker"
+	if len(fields) < 13 {
+		return messageError(g, string(message), ReasonFieldCount)
+	}
+	g.Uniqid = internID(fields[0][len("imei:"):])
+	s.Device = g.Uniqid
+
+	switch string(fields[1]) {
+	case "help me":
+		g.Alert = AlertSOS
+	case "low battery":
+		g.Alert = AlertBatteryLow
+		g.BatteryLow = true
+	case "speed":
+		g.Alert = AlertOverSpeed
+	case "ac alarm":
+		g.Alert = AlertBatteryDisconnected
+	case "acc on":
+		g.Alert = AlertIgnitionOn
+		g.StatusIgnition = true
+	case "acc off":
+		g.Alert = AlertIgnitionOff
+	case "sensor alarm":
+		g.Alert = AlertVibration
+	}
+
+	// L instead of F means the device only knows the cell it is in, which we do not publish
+	switch string(fields[4]) {
+	case "F":
+	case "L":
+		return errNoData
+	default:
+		return fieldError(g, 4, string(fields[4]), ReasonBadValue)
+	}
+
+	// The date comes from the local yymmddhhmm at field 2, the time from the UTC hhmmss.sss at field 5
+	local := fields[2]
+	if len(local) != 10 {
+		return fieldError(g, 2, string(local), ReasonBadTime)
+	}
+	date, ok := unixMillis([]byte{local[4], local[5], local[2], local[3], local[0], local[1]}, midnight)
+	if !ok {
+		return fieldError(g, 2, string(local), ReasonBadTime)
+	}
+	localClock, ok := nmeaTime([]byte{local[6], local[7], local[8], local[9], '0', '0'})
+	if !ok {
+		return fieldError(g, 2, string(local), ReasonBadTime)
+	}
+	clock, ok := nmeaTime(fields[5])
+	if !ok {
+		return fieldError(g, 5, string(fields[5]), ReasonBadTime)
+	}
+	// Around midnight the local date can be a day ahead of or behind the UTC one,
+	// which shows as the local clock being more than 12 hours off the UTC clock
+	switch offset := localClock - clock; {
+	case offset < -dayMillis/2:
+		date -= dayMillis
+	case offset > dayMillis/2:
+		date += dayMillis
+	}
+	g.TS_Millis = date + clock
+
+	var err error
+	if g.InvalidFix, err = fixField(g, fields, 6); err != nil {
+		return err
+	}
+	if g.ActualLat, err = nmeaField(g, fields, 7); err != nil {
+		return err
+	}
+	if g.ActualLng, err = nmeaField(g, fields, 9); err != nil {
+		return err
+	}
+
+	// Speed and course are left empty when the device does not know them
+	if len(fields[11]) > 0 {
+		speed, err := floatField(g, fields, 11, 0, 1000)
+		if err != nil {
+			return err
+		}
+		g.Speed = knotsToKmph(speed)
+	}
+	if len(fields[12]) > 0 {
+		course, err := floatField(g, fields, 12, 0, 360)
+		if err != nil {
+			return err
+		}
+		g.Direction = int(math.Round(course))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package gpsparser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTK103(t *testing.T) {
+	assert := assert.New(t)
+	p := NewParser("10.1.2.3:5555")
+
+	// Login and heartbeat are answered, and carry nothing to publish
+	records, errs := p.ParseMessages([]byte("##,imei:359586015829802,A;359586015829802;"))
+	assert.Empty(records)
+	assert.Empty(errs)
+	assert.Equal("359586015829802", p.Session.Device)
+	assert.Equal("LOADON", string(p.Session.Reply()))
+
+	records, errs = p.ParseMessages([]byte("imei:359586015829802,tracker,0809231929,13554900601,F,112909.397,A,2234.4669,N,11354.3287,E,0.11,;" +
+		"imei:359586015829802,help me,0809231930,13554900601,F,113009,A,2234.4669,S,11354.3287,W,20.5,90.4;" +
+		"imei:359586015829802,tracker,0809231931,,L,,,1d5b,,5e2b,,,,;"))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		g := records[0]
+		assert.Equal("TK103", g.Protocol)
+		assert.Equal("tracker", g.PacketType)
+		assert.Equal("359586015829802", g.Uniqid)
+		assert.Equal(int64(1222169349397), g.TS_Millis)
+		assert.InDelta(22.574448, g.ActualLat, 1e-6)
+		assert.InDelta(113.905478, g.ActualLng, 1e-6)
+		assert.Equal(0, g.Speed)
+		assert.Empty(g.Alert)
+
+		assert.Equal(AlertSOS, records[1].Alert)
+		assert.InDelta(-22.574448, records[1].ActualLat, 1e-6)
+		assert.Equal(38, records[1].Speed)
+		assert.Equal(90, records[1].Direction)
+	}
+	assert.Empty(p.Session.Reply())
+
+	// The local date is moved to the UTC one when they straddle midnight:
+	// 2026-10-19 00:30 at +05:30 is 2026-10-18 19:00 UTC, 2026-10-18 23:00 at -10:00 is 2026-10-19 09:00 UTC
+	records, errs = p.ParseMessages([]byte("imei:359586015829802,tracker,2610190030,,F,190000,A,2234.4669,N,11354.3287,E,0,;" +
+		"imei:359586015829802,tracker,2610182300,,F,090000,A,2234.4669,N,11354.3287,E,0,;"))
+	assert.Empty(errs)
+	if assert.Len(records, 2) {
+		assert.Equal(int64(1792350000000), records[0].TS_Millis) // 2026-10-18T19:00:00Z
+		assert.Equal(int64(1792400400000), records[1].TS_Millis) // 2026-10-19T09:00:00Z
+	}
+
+	split := FrameSplit([]byte("##,imei:359586015829802,A;imei:"))
+	if assert.NotNil(split) {
+		advance, token, err := split([]byte("##,imei:359586015829802,A;imei:"), false)
+		assert.NoError(err)
+		assert.Equal(26, advance)
+		assert.Equal("##,imei:359586015829802,A;", string(token))
+	}
+	assert.NotNil(FrameSplit([]byte("359586015829802;")))
+	assert.Nil(FrameSplit([]byte("359586015829802")))
+}
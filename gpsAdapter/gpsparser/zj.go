@@ -0,0 +1,108 @@
+package gpsparser
+
+import (
+	"bytes"
+	"math"
+)
+
+// ZJ is the legacy WTD protocol still spoken by our old fleet and by the client simulator
+// A frame looks like *ZJ,2030295119,V1,hhmmss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,angle,ddmmyy,status#
+// Time and date are in UTC and speed is in knots
+type zj struct{}
+
+func init() {
+	Register(zj{})
+}
+
+func (zj) Name() string {
+	return "ZJ"
+}
+
+func (zj) Detect(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte("*ZJ"))
+}
+
+func (zj) Parse(s *Session, records []GPSParsed, errs []error, raw []byte) ([]GPSParsed, []error) {
+	// Multiple frames can arrive together, each one terminated by #
+	return parseFrames(s, records, errs, raw, '#', parseZJ)
+}
+
+// The telemetry of the position packet (V1)
+var zjPositionFields = []field{fieldSpeed, fieldDir}
+
+func (zj) telemetry(g *GPSParsed) []field {
+	if g.PacketType == "V1" {
+		return zjPositionFields
+	}
+	return nil
+}
+
+// parseZJ parses a single ZJ frame (without the trailing #) into g
+// Every frame carries the device ID, so the session is not needed
+func parseZJ(_ *Session, g *GPSParsed, message []byte) error {
+	g.Raw = message
+	g.Protocol = "ZJ"
+
+	// An empty *ZJ# frame carries no data
+	if string(message) == "*ZJ" {
+		return errNoData
+	}
+
+	var buf [16][]byte
+	fields := splitFields(buf[:0], message)
+	if len(fields) == 1 {
+		return messageError(g, string(message), ReasonNotCSV)
+	}
+	if len(fields) != 13 {
+		return messageError(g, string(message), ReasonFieldCount)
+	}
+
+	// 1st field is the device ID and 2nd field the packet type, only V1 is known
+	g.Uniqid = internID(fields[1])
+	if string(fields[2]) != "V1" {
+		g.PacketType = unknownPacketType
+		return fieldError(g, 2, string(fields[2]), ReasonUnknownPacket)
+	}
+	g.PacketType = "V1"
+
+	return v1Position(g, fields)
+}
+
+// v1Position parses the position fields of a V1 frame, which ZJ and H02 share
+// *ZJ,id,V1,hhmmss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,angle,ddmmyy,...
+func v1Position(g *GPSParsed, fields [][]byte) error {
+	// 3rd field is hhmmss and 11th field ddmmyy, both in UTC
+	var err error
+	if g.TS_Millis, err = timeField(g, fields, 11, 3); err != nil {
+		return err
+	}
+
+	// 4th field is the GPS fix validity
+	if g.InvalidFix, err = fixField(g, fields, 4); err != nil {
+		return err
+	}
+
+	// 5th and 7th fields contain the coordinates in NMEA format, followed by their hemisphere
+	if g.ActualLat, err = nmeaField(g, fields, 5); err != nil {
+		return err
+	}
+	if g.ActualLng, err = nmeaField(g, fields, 7); err != nil {
+		return err
+	}
+
+	// 9th field contains speed in knots
+	speed, err := floatField(g, fields, 9, 0, 200)
+	if err != nil {
+		return err
+	}
+	g.Speed = knotsToKmph(speed)
+
+	// 10th field contains the heading in degrees
+	angle, err := floatField(g, fields, 10, 0, 360)
+	if err != nil {
+		return err
+	}
+	g.Direction = int(math.Round(angle))
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package gpsparser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZJ(t *testing.T) {
+	assert := assert.New(t)
+
+	// What the client simulator sends
+	records, errs := ParseMessages([]byte("*ZJ,2030295119,V1,062804,A,3106.3677,N,7710.9352,E,2.38,0.00,290518,00000000#\n"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		g := records[0]
+		assert.Equal("ZJ", g.Protocol)
+		assert.Equal("V1", g.PacketType)
+		assert.Equal("2030295119", g.Uniqid)
+		assert.Equal(int64(1527575284000), g.TS_Millis)
+		assert.InDelta(31.106128, g.ActualLat, 1e-6)
+		assert.InDelta(77.182253, g.ActualLng, 1e-6)
+		assert.Equal(4, g.Speed)
+	}
+
+	// Southern and western hemispheres
+	records, errs = ParseMessages([]byte("*ZJ,2030295119,V1,062804,A,3106.3677,S,07710.9352,W,0.00,271.6,290518,00000000#"))
+	assert.Empty(errs)
+	if assert.Len(records, 1) {
+		assert.InDelta(-31.106128, records[0].ActualLat, 1e-6)
+		assert.InDelta(-77.182253, records[0].ActualLng, 1e-6)
+		assert.Equal(272, records[0].Direction)
+	}
+
+	// Empty frame, bad minutes and wrong field count
+	records, errs = ParseMessages([]byte("*ZJ#*ZJ,2030295119,V1,062804,A,3160.0000,N,7710.9352,E,0,0,290518,00000000#*ZJ,2030295119,V1#"))
+	assert.Empty(records)
+	if assert.Len(errs, 2) {
+		assert.Equal(&ParseError{Protocol: "ZJ", PacketType: "V1", Field: 5, Value: "3160.0000", Reason: ReasonBadCoordinate}, errs[0])
+		assert.True(errors.Is(errs[1], ReasonFieldCount))
+	}
+
+	// A latitude past the pole
+	_, errs = ParseMessages([]byte("*ZJ,2030295119,V1,062804,A,9906.3677,N,7710.9352,E,2.38,0.00,290518,00000000#"))
+	if assert.Len(errs, 1) {
+		assert.Equal(&ParseError{Protocol: "ZJ", PacketType: "V1", Field: 5, Value: "9906.3677", Reason: ReasonOutOfRange}, errs[0])
+	}
+
+	// Packet types other than V1 are not taken for positions
+	records, errs = ParseMessages([]byte("*ZJ,2030295119,XX,062804,A,3106.3677,N,7710.9352,E,2.38,0.00,290518,00000000#"))
+	assert.Empty(records)
+	if assert.Len(errs, 1) {
+		assert.Equal(&ParseError{Protocol: "ZJ", PacketType: "unknown", Field: 2, Value: "XX", Reason: ReasonUnknownPacket}, errs[0])
+	}
+}
+
+func TestNmeaDegrees(t *testing.T) {
+	assert := assert.New(t)
+
+	lat, reason := nmeaDegrees([]byte("0000.0000"), []byte("N"))
+	assert.Empty(reason)
+	assert.Equal(0.0, lat)
+
+	lng, reason := nmeaDegrees([]byte("17959.9999"), []byte("W"))
+	assert.Empty(reason)
+	assert.InDelta(-179.9999983, lng, 1e-6)
+
+	_, reason = nmeaDegrees([]byte("abc"), []byte("N"))
+	assert.Equal(ReasonBadCoordinate, reason)
+	_, reason = nmeaDegrees([]byte("1234.5"), []byte("Q"))
+	assert.Equal(ReasonBadHemisphere, reason)
+
+	// Latitudes go up to 90 degrees and longitudes up to 180
+	_, reason = nmeaDegrees([]byte("9906.3677"), []byte("N"))
+	assert.Equal(ReasonOutOfRange, reason)
+	_, reason = nmeaDegrees([]byte("18000.0001"), []byte("E"))
+	assert.Equal(ReasonOutOfRange, reason)
+	lat, reason = nmeaDegrees([]byte("9000.0000"), []byte("S"))
+	assert.Empty(reason)
+	assert.Equal(-90.0, lat)
+}
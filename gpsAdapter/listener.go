@@ -0,0 +1,133 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	stream "github.com/reisub1/go/gpsAdapter/stream"
+)
+
+// Listener is an address devices send their data to
+// Every vendor is provisioned with its own port, so most listeners are bound to the one protocol that vendor speaks
+type Listener struct {
+	Transport string `json:"transport"` // tcp or udp
+	Addr      string `json:"addr"`      // host:port to listen on
+	Protocol  string `json:"protocol"`  // Name of the gpsparser protocol spoken here, or auto to detect it from the data
+	Device    string `json:"device"`    // ID of the device sending here when its protocol carries none (NMEA), its IP otherwise
+
+	protocol gpsparser.Protocol // nil for auto
+	metrics  *listenerMetrics
+}
+
+// Counters for every listener, published through expvar so they show up in /debug/vars
+var listenerVars = expvar.NewMap("gpsadapter_listeners")
+
+// The counters of a single listener
+type listenerMetrics struct {
+	connections expvar.Int // TCP connections accepted, or UDP addresses seen
+	open        expvar.Int // TCP connections open, or UDP addresses remembered
+	bytes       expvar.Int // Bytes received
+	frames      expvar.Int // Frames (TCP) or datagrams (UDP) received
+	errors      expvar.Int // Errors parsing them
+	dropped     expvar.Int // TCP connections closed for sending garbage, or UDP datagrams too long to parse
+}
+
+// String names the listener in logs and metrics, e.g. tcp://0.0.0.0:5023 GT06
+func (l *Listener) String() string {
+	return fmt.Sprintf("%s://%s %s", l.Transport, l.Addr, l.Protocol)
+}
+
+// validate checks the listener and looks up its protocol
+func (l *Listener) validate() error {
+	switch l.Transport {
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("listener %s: transport must be tcp or udp", l)
+	}
+	if l.Addr == "" {
+		return fmt.Errorf("listener %s: no address", l)
+	}
+	if l.Protocol == "" {
+		l.Protocol = "auto"
+	}
+	if l.Protocol != "auto" {
+		if l.protocol = gpsparser.Lookup(l.Protocol); l.protocol == nil {
+			return fmt.Errorf("listener %s: unknown protocol, use auto or one of %s", l, strings.Join(gpsparser.Protocols(), ", "))
+		}
+	}
+	return nil
+}
+
+// setUp publishes the metrics of the listener, it is done once the listener is about to be served
+func (l *Listener) setUp() {
+	l.metrics = new(listenerMetrics)
+	m := new(expvar.Map).Init()
+	m.Set("connections", &l.metrics.connections)
+	m.Set("open", &l.metrics.open)
+	m.Set("bytes", &l.metrics.bytes)
+	m.Set("frames", &l.metrics.frames)
+	m.Set("errors", &l.metrics.errors)
+	m.Set("dropped", &l.metrics.dropped)
+	listenerVars.Set(l.String(), m)
+}
+
+// split cuts the next frame off the data received on this listener
+func (l *Listener) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if l.protocol == nil {
+		return splitFrames(data, atEOF)
+	}
+	if f, ok := l.protocol.(gpsparser.Framer); ok {
+		return f.Split(data, atEOF)
+	}
+	return stream.SplitText(data, atEOF)
+}
+
+// newParser returns a parser for a device sending to this listener from remote, on the connection named conn
+func (l *Listener) newParser(remote string, conn string) *gpsparser.Parser {
+	p := gpsparser.NewParser(remote)
+	p.Protocol = l.protocol
+	p.Session.Conn = conn
+	p.Session.Fallback = l.Device
+	return p
+}
+
+// publish parses frame with parser, puts the records found on the jsonChan and counts the errors
+// A parser that panics on a frame is a bug, it is logged and counted as an error and ok is false,
+// the caller then drops the connection so that one bad frame does not take every other device down with it
+func (l *Listener) publish(parser *gpsparser.Parser, frame []byte) (errs []error, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			l.metrics.errors.Add(1)
+			log.Errorf("%s: parser panic on %q: %v\n%s", parser.Session.Conn, frame, r, debug.Stack())
+			errs, ok = nil, false
+		}
+	}()
+	errs = parser.Publish(frame, jsonChan)
+	l.metrics.errors.Add(int64(len(errs)))
+	return errs, true
+}
+
+// parseListeners parses listeners as given in the environment or as a flag, transport://addr/protocol separated by commas
+// The protocol can be left out to detect it from the data, e.g. tcp://0.0.0.0:5023/GT06,udp://0.0.0.0:8000
+func parseListeners(s string) ([]*Listener, error) {
+	var listeners []*Listener
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "://")
+		if i < 0 {
+			return nil, fmt.Errorf("listener %q: must be transport://addr/protocol", spec)
+		}
+		l := &Listener{Transport: spec[:i], Addr: spec[i+3:]}
+		if j := strings.IndexByte(l.Addr, '/'); j >= 0 {
+			l.Addr, l.Protocol = l.Addr[:j], l.Addr[j+1:]
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -4,48 +4,54 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	logging "github.com/op/go-logging"
 	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
 	mq "github.com/reisub1/go/gpsAdapter/mq"
+	stream "github.com/reisub1/go/gpsAdapter/stream"
 	evio "github.com/tidwall/evio"
 )
 
 const (
-	// The IP/Port where the Legacy GPS Data is coming to
-	LISTENHOST = "0.0.0.0"
-	LISTENPORT = "8000"
-
-	// The MQTT Broker IP/Port
-	// MQTTHOST       = "tcp://192.168.1.20:1883"
-	MQTTHOST = "tcp://127.0.0.1:1883"
-
 	// Just a convenience variable containing Go's Example-driven method of parsing Time
 	// The time and date usually comes in a concatenated format
 	TIMEDATEFORMAT = "150405:020106"
 
-	// The ThingsBoard access token for the Gateway device
-	ACCESSTOKEN = "G5d65KPhrJkgL1CfflMa"
+	// The longest frame a device may send, connections sending more than this without ending a frame are closed
+	MAXFRAMESIZE = 4096
+
+	// How long a device sending over UDP is remembered after its last datagram
+	UDPSESSIONTIMEOUT = 10 * time.Minute
+
+	// How long a shutdown waits for the data already received to be published before giving up on it
+	SHUTDOWNTIMEOUT = 10 * time.Second
 )
 
+// The configuration the adapter runs with, see loadConfig
+var config *Config
+
 // This variable represents the MQTT connection that is to be persisted, and finally disconnected when the program closes
 // All communication with ThingsBoard occurs through the MQTT Api
 var c *mqtt.Client
 
-// Just for convenience sake, an empty error type
-var e error
-
-// This channel contains pointers to all JSON Strings to be sent
-// Another function, dispatcher, chooses one of these elements and processes it by publishing it to MQTT Broker
-var jsonChan chan *string
+// This channel contains pointers to all parsed records to be sent, they are only encoded to JSON by the workers
+// Another function, dispatcher, chooses one of these elements and hands it to a worker which publishes it to MQTT Broker
+var jsonChan chan *gpsparser.Envelope
 
 // This is a map of string[bool] to keep track of already connected devices to prevent sending redundant connect requests
 // This is synchronized with RWMutex to ensure concurrent access by different goroutines
@@ -54,42 +60,115 @@ var deviceStatus = struct {
 	connected map[string]bool
 }{connected: make(map[string]bool)}
 
+// Everything kept for one device connection
+type connection struct {
+	// The listener the connection came in on
+	listener *Listener
+	// The data received that is not a whole frame yet
+	buffer *stream.Buffer
+	// The parser for this connection, it remembers who the device is for protocols that do not say it in every message
+	parser *gpsparser.Parser
+}
+
+// This is a map of evio connection id to its connection
+// Entries are added when a connection opens and released when it closes
+var connections = struct {
+	sync.Mutex
+	conns map[int]*connection
+}{conns: make(map[int]*connection)}
+
 func main() {
-	f, err := os.Create("prof")
-	if err != nil {
-		log.Fatal(err)
+	var err error
+	if config, err = loadConfig(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	if config.Profile != "" {
+		f, err := os.Create(config.Profile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
 	}
-	pprof.StartCPUProfile(f)
-	defer pprof.StopCPUProfile()
-	setUpLogging()
+	setUpLogging(config.LogFile)
+	config.apply()
 	signalHandler()
 	log.Info("Runtime GoMAXPROCS = ", runtime.GOMAXPROCS(0))
+	log.Info("Supported protocols = ", strings.Join(gpsparser.Protocols(), ", "))
 
-	// Connect to the MQTT broker
-	c, e = mq.Connect(MQTTHOST, ACCESSTOKEN)
-	if e != nil {
-		log.Critical(e)
-		log.Info("Are you sure MQTT Broker is up and running?")
+	// Connect to the MQTT broker, records are kept in the backlog until it can be reached
+	c = mq.Connect(config.Broker, config.token, brokerConnected, brokerLost)
+	if err := startForwarding(); err != nil {
+		log.Critical(err)
 		os.Exit(1)
 	}
 
-	// Disconnect upon end
+	jsonChan = make(chan *gpsparser.Envelope, 100)
+	if err := startPublishing(jsonChan); err != nil {
+		log.Critical(err)
+		os.Exit(1)
+	}
+	go errorReporter(time.Minute)
 
-	jsonChan = make(chan *string, 100)
-	go dispatcher(jsonChan)
+	// Phone apps post their positions over HTTP, on a mux of their own so they cannot reach /debug/vars
+	if config.HTTPListen != "" {
+		osmand := http.NewServeMux()
+		osmand.HandleFunc("/", osmandHandler)
+		producers.Add(1)
+		go serveHTTP("HTTP", config.HTTPListen, osmand)
+	}
+	// expvar publishes its counters on the default mux
+	if config.Metrics != "" {
+		producers.Add(1)
+		go serveHTTP("Metrics", config.Metrics, http.DefaultServeMux)
+	}
+
+	// Some firmwares only send over UDP to save data, those listeners are served on their own
+	// and all TCP listeners are served together by evio
+	var tcpListeners []*Listener
+	var addrs []string
+	for _, l := range config.Listeners {
+		l.setUp()
+		if l.Transport == "udp" {
+			producers.Add(1)
+			go serveUDP(l)
+			continue
+		}
+		tcpListeners = append(tcpListeners, l)
+		addrs = append(addrs, "tcp://"+l.Addr)
+	}
 
 	// Make an empty set of events
 	var events evio.Events
 
-	// Perform this action when the listen server on :8000 starts
+	// Perform this action when the listen servers start
 	events.Serving = func(srvin evio.Server) (_ evio.Action) {
-		log.Noticef("server started on port %s", LISTENPORT)
+		for _, l := range tcpListeners {
+			log.Noticef("server started on %s", l)
+		}
 		return
 	}
 
 	// Perform this action whenever a new connection is received
 	events.Opened = func(id int, info evio.Info) (_ []byte, _ evio.Options, _ evio.Action) {
 		// log.Infof("Connection %d launched %s -> %s", id, info.RemoteAddr, info.LocalAddr)
+		// evio tells which of the addresses the connection came in on
+		l := tcpListeners[info.AddrIndex]
+		l.metrics.connections.Add(1)
+		l.metrics.open.Add(1)
+		connections.Lock()
+		connections.conns[id] = &connection{
+			listener: l,
+			buffer:   stream.NewBuffer(l.split, MAXFRAMESIZE),
+			parser:   l.newParser(info.RemoteAddr.String(), fmt.Sprintf("tcp/%d", id)),
+		}
+		connections.Unlock()
 		return
 	}
 
@@ -99,87 +178,253 @@ func main() {
 	// Perform this action whenever a connection closes
 	events.Closed = func(id int, _ error) (_ evio.Action) {
 		// log.Infof("Connection %d closed", id)
+		connections.Lock()
+		if conn := connections.conns[id]; conn != nil {
+			conn.listener.metrics.open.Add(-1)
+			delete(connections.conns, id)
+		}
+		connections.Unlock()
 		return
 	}
 
-	// Start the server on LISTENHOST:LISTENPORT
-	if err := evio.Serve(events, fmt.Sprintf("tcp://%s:%s", LISTENHOST, LISTENPORT)); err != nil {
+	// Stop the servers once the adapter is asked to, evio closes every connection before Serve returns
+	events.Tick = func() (delay time.Duration, action evio.Action) {
+		select {
+		case <-stopping:
+			action = evio.Shutdown
+		default:
+		}
+		return 100 * time.Millisecond, action
+	}
+
+	// Start the servers on all TCP listeners
+	if len(addrs) == 0 {
+		<-stopping
+	} else if err := evio.Serve(events, addrs...); err != nil {
 		panic(err.Error())
 	}
+
+	// Nothing comes in over TCP anymore, send what was received before letting go
+	shutdown()
 }
 
 // dataHandler is the function called asynchronously upon a new Data connection from a client
-// This parses the message in the WTD Protocol format and then Publishes it as JSON for the thingsboard MQTT Gateway API
+// This detects the protocol of the message, parses it and then Publishes it as JSON for the thingsboard MQTT Gateway API
 func dataHandler(id int, in []byte) (out []byte, action evio.Action) {
-
-	// Assuming only messages terminated by newlines are valid
-	message := strings.TrimRight(string(in), "\n")
+	connections.Lock()
+	conn := connections.conns[id]
+	connections.Unlock()
+	if conn == nil {
+		return
+	}
 
 	// Log the message for debugging
-	// log.Infof("Received message of length %d: %s", len(message), message)
+	// log.Infof("Received data of length %d: %s", len(in), in)
 
-	// Hand off the message pointer to Parse function, it will put any parsed data it finds on the
-	// parsedChannel
-	go gpsparser.Parse(&message, jsonChan)
+	// TCP does not keep message boundaries, in can hold part of a frame or several of them
+	// The buffer hands over every frame that is now complete and keeps the rest until more data arrives
+	// Parsing works directly on evio's buffer and is cheap, so it is done right here instead of in a goroutine
+	// It puts any parsed data it finds on the jsonChan and gives back whatever it could not parse
+	metrics := conn.listener.metrics
+	metrics.bytes.Add(int64(len(in)))
+	failed := false
+	err := conn.buffer.Write(in, func(frame []byte) {
+		if failed {
+			return
+		}
+		metrics.frames.Add(1)
+		errs, ok := conn.listener.publish(conn.parser, frame)
+		failed = !ok
+		for _, err := range errs {
+			log.Debugf("Connection %d: %s", id, err)
+		}
+	})
+	if failed {
+		metrics.dropped.Add(1)
+		log.Warningf("Connection %d closed: the frame could not be parsed", id)
+		return nil, evio.Close
+	}
+	if err != nil {
+		metrics.dropped.Add(1)
+		log.Warningf("Connection %d closed: %s", id, err)
+		action = evio.Close
+	}
 
-	// We are done, we can return to let the garbage collector handle this stuff
+	// Some devices (GT06, Teltonika, TK103) stop talking until they are answered, evio writes out back to the device
+	out = conn.parser.Session.Reply()
 	return
 }
 
-// This is the function that dispatches goroutines to publish the newly gained data to ThingsBoard through the MQTT Gateway API
-func dispatcher(workChannel chan *string) {
+// splitFrames cuts the next frame off the data received on a connection
+// Binary protocols say how long their frames are, everything else ends its frames with # or a newline
+func splitFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if split := gpsparser.FrameSplit(data); split != nil {
+		return split(data, atEOF)
+	}
+	return stream.SplitText(data, atEOF)
+}
+
+// serveHTTP serves handler on addr, it runs until the listener fails or the adapter stops
+// Requests that are being handled when the adapter stops are still answered, so their reports reach the jsonChan
+func serveHTTP(name string, addr string, handler http.Handler) {
+	defer producers.Done()
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	stopped := make(chan struct{})
+	go func() {
+		<-stopping
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWNTIMEOUT)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(stopped)
+	}()
+
+	log.Noticef("%s server started on %s", name, addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Critical(err)
+		return
+	}
+	<-stopped
+}
+
+// osmandHandler turns a position report posted as a query string (or form body) into records on the jsonChan
+// ?id=...&lat=...&lon=...&timestamp=...&speed=...
+func osmandHandler(w http.ResponseWriter, r *http.Request) {
+	query := []byte(r.URL.RawQuery)
+	if len(query) == 0 && r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAXFRAMESIZE))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = body
+	}
+
+	// Every report stands on its own, the session only says where it came from
+	// Only OsmAnd is taken here, whatever else is posted is not detected
+	p := gpsparser.NewParser(r.RemoteAddr)
+	p.Protocol = gpsparser.Lookup("OsmAnd")
+	p.Session.Conn = "http/" + r.RemoteAddr
+	if errs := p.Publish(query, jsonChan); len(errs) > 0 {
+		for _, err := range errs {
+			log.Debugf("HTTP %s: %s", r.RemoteAddr, err)
+		}
+		http.Error(w, errs[0].Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// This is the function that hands the newly gained data over to the workers, which publish it to ThingsBoard
+// It puts records on the lane of their device following the overflow policy, and feeds the lanes from the spool when spilling
+// It returns once workChannel is closed and empty, then closes the lanes so the workers return once they are empty too
+func dispatcher(workChannel chan *gpsparser.Envelope) {
+	defer publishing.Done()
+
+	// The oldest spooled record, waiting for room on the queue
+	var next *gpsparser.Envelope
 	for {
+		if next == nil && spill != nil {
+			next = unspool()
+		}
+		// Sending on a nil channel blocks forever, so that case is off while there is nothing spooled
+		var out chan *gpsparser.Envelope
+		if next != nil {
+			out = laneOf(next.Device)
+		}
+
 		select {
-		case jsonString := <-workChannel:
-			go func() {
-				uniqid := strings.SplitN(*jsonString, "\"", 3)[1]
-				deviceStatus.RLock()
-				currentStatus := deviceStatus.connected[uniqid]
-				deviceStatus.RUnlock()
-				if !currentStatus {
-					deviceJson := fmt.Sprintf(`{"device": "%s"}`, uniqid)
-					mq.Publish(c, deviceJson, "v1/gateway/connect")
-					deviceStatus.Lock()
-					deviceStatus.connected[uniqid] = true
-					deviceStatus.Unlock()
+		case envelope, ok := <-workChannel:
+			if !ok {
+				// What is left in the spool waits there for the next start
+				if next != nil {
+					laneOf(next.Device) <- next
+				}
+				for _, lane := range lanes {
+					close(lane)
+				}
+				if spill != nil {
+					if err := spill.Close(); err != nil {
+						log.Errorf("Spool: %s", err)
+					}
 				}
-				mq.Publish(c, *jsonString, "v1/gateway/telemetry")
-			}()
+				return
+			}
+			// Devices that are not allowed, or that send too much, are dropped before they reach ThingsBoard
+			if !allowRecord(envelope) {
+				continue
+			}
+			enqueue(envelope, next != nil)
+		case out <- next:
+			next = nil
+		}
+	}
+}
+
+// errorReporter logs how many messages were rejected in every interval, grouped by why they were rejected
+// and how many records were dropped for lack of room in the queue
+func errorReporter(interval time.Duration) {
+	last := make(map[string]int64)
+	var lastDropped int64
+	for range time.Tick(interval) {
+		for key, count := range gpsparser.ErrorCounts() {
+			if rejected := count - last[key]; rejected > 0 {
+				log.Warningf("%d messages rejected in the last %s: %s", rejected, interval, key)
+			}
+			last[key] = count
+		}
+		dropped := queueVars.dropped.Value()
+		if dropped > lastDropped {
+			log.Warningf("%d records dropped in the last %s: queue full (%s)", dropped-lastDropped, interval, overflow)
 		}
+		lastDropped = dropped
 	}
 }
 
 // Global log variable to provide logging
 var log = logging.MustGetLogger("server")
 
-// In short this function just sets up colourful logging with a fixed format
-func setUpLogging() {
-	f, err := os.Create("/var/log/gpsAdapter.log")
-	if err != nil {
-		println("Unable to open log file, only logging to stderr")
-	}
-
-	logStderr := logging.NewLogBackend(os.Stderr, "", 0)
-	logfile := logging.NewLogBackend(f, "", 0)
+// In short this function just sets up colourful logging with a fixed format, to stderr and to path if it is not empty
+func setUpLogging(path string) {
 	var format = logging.MustStringFormatter(
 		`%{color}%{id:0d} %{time:15:04:05.000} %{shortfunc} -> %{level:s} | %{message}%{color:reset}`,
 	)
-	Formatted := logging.NewBackendFormatter(logStderr, format)
-	FormattedFile := logging.NewBackendFormatter(logfile, format)
-	logging.SetBackend(Formatted, FormattedFile)
+	logStderr := logging.NewLogBackend(os.Stderr, "", 0)
+	backends := []logging.Backend{logging.NewBackendFormatter(logStderr, format)}
+
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			println("Unable to open log file, only logging to stderr")
+		} else {
+			logfile := logging.NewLogBackend(f, "", 0)
+			backends = append(backends, logging.NewBackendFormatter(logfile, format))
+		}
+	}
+	logging.SetBackend(backends...)
 }
 
-// Handle SIGINT by sending disconnect request to the MQTT Gateway Broker
+// Handle SIGINT and SIGTERM by stopping the servers, main then shuts down cleanly, see shutdown
+// A second one exits right away, for when the shutdown is stuck
+// Handle SIGHUP by reloading the configuration, see reload
 func signalHandler() {
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		for sig := range sigchan {
+			if sig == syscall.SIGHUP {
+				log.Notice("Reloading the configuration due to Signal: ", sig)
+				reload(os.Args[1:])
+				continue
+			}
+			select {
+			case <-stopping:
+				log.Warningf("Server exiting due to second Signal: %s", sig)
+				os.Exit(1)
+			default:
+			}
 			log.Warningf("Server closing due to Signal: %s", sig)
-			// Disconnect with 1000 ms time to cleanup
-			(*c).Disconnect(1000)
-			// Exit cleanly
-			os.Exit(0)
+			close(stopping)
 		}
 	}()
 }
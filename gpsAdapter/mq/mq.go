@@ -1,39 +1,79 @@
 package mq
 
 import (
+	"errors"
+	"time"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	// mq "github.com/surgemq/surgemq"
 	// mqService "github.com/surgemq/surgemq/service"
 )
 
+// The longest wait between two attempts to connect to the broker
+const MaxBackoff = time.Minute
+
+// How often the broker is pinged when nothing else is sent, so a connection that died silently is found out
+const KeepAlive = 30 * time.Second
+
+// How long Publish waits for the broker to acknowledge a message
+const PublishTimeout = 30 * time.Second
+
+// ErrTimeout is returned by Publish when the broker did not acknowledge the message in time, it may or may not have it
+var ErrTimeout = errors.New("no acknowledgement from the broker")
+
 // Connects to the given broker with the username set as the accesstoken for ThingsBoard
 // Returns a client object which must be stored to reuse this connection
-func Connect(broker string, access_token string) (*mqtt.Client, error) {
-	var e error
-
+// It never gives up: the first connection is attempted in the background and retried with backoff until it succeeds,
+// and once connected paho reconnects by itself. connected and lost are called every time the connection comes and goes
+func Connect(broker string, access_token string, connected func(), lost func(error)) *mqtt.Client {
 	// Set up the client parameters
 	opts := mqtt.NewClientOptions().AddBroker(broker)
 	opts.SetUsername(access_token)
 	opts.SetClientID("tbBridge")
-	opts.SetKeepAlive(0)
+	opts.SetKeepAlive(KeepAlive)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(MaxBackoff)
+	opts.SetOnConnectHandler(func(mqtt.Client) { connected() })
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost(err) })
 	client := mqtt.NewClient(opts)
 
-	// Attempt a connection
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		e = token.Error()
-	}
+	// Attempt a connection, doubling the wait after every failure
+	go func() {
+		backoff := time.Second
+		for {
+			token := client.Connect()
+			if token.Wait() && token.Error() == nil {
+				return
+			}
+			lost(token.Error())
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+		}
+	}()
 
 	// Return the client for further calls
-	return &client, e
+	return &client
+}
+
+// Online tells whether the client is connected to the broker right now
+func Online(c *mqtt.Client) bool {
+	return (*c).IsConnectionOpen()
 }
 
 // A simple wrapper around Paho.Mqtt.Golang that publishes the message to the topic, given the client
+// The message is sent with QoS 1 and Publish returns once the broker acknowledged it, so a nil error means it got there
+// It fails with mqtt.ErrNotConnected or ErrTimeout when the message may not have reached the broker
 func Publish(c *mqtt.Client, message string, topic string) error {
-	var e error
-	if token := (*c).Publish(topic, 0, false, message); token.Wait() && token.Error() != nil {
-		e = token.Error()
+	if !Online(c) {
+		return mqtt.ErrNotConnected
+	}
+	token := (*c).Publish(topic, 1, false, message)
+	if !token.WaitTimeout(PublishTimeout) {
+		return ErrTimeout
 	}
-	return e
+	return token.Error()
 }
 
 type Client mqtt.Client
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	mq "github.com/reisub1/go/gpsAdapter/mq"
+	spool "github.com/reisub1/go/gpsAdapter/spool"
+)
+
+// What the dispatcher does with a record when the queue is full
+const (
+	// Wait for a worker to take one, which holds back the servers and in turn the devices
+	OverflowBlock = "block"
+	// Drop the record that has waited the longest, to always publish the freshest data
+	OverflowDropOldest = "drop-oldest"
+	// Keep it in the spool on disk until the queue has room, records stay in order
+	OverflowSpill = "spill"
+)
+
+// The records waiting for a worker, filled by the dispatcher and emptied by the workers
+// There is one lane per worker, and every device always goes to the same lane, see laneOf
+// So records of one device are published one after the other in the order they were received,
+// while different devices are published in parallel
+var lanes []chan *gpsparser.Envelope
+
+// The overflow policy of the queue
+var overflow string
+
+// Where records wait when the queue is full and the overflow policy is spill, nil otherwise
+var spill *spool.Spool
+
+// Counters for the queue, published through expvar so they show up in /debug/vars along with the queue depth
+var queueVars = struct {
+	dropped   expvar.Int // Records dropped because the queue (and the spool) was full
+	spilled   expvar.Int // Records that went through the spool
+	published expvar.Int // Publications sent to the broker, a record makes one for telemetry and one for attributes
+	failed    expvar.Int // Records that could not be encoded, and publications the broker did not take
+}{}
+
+func init() {
+	m := expvar.NewMap("gpsadapter_queue")
+	m.Set("depth", expvar.Func(func() interface{} { return queued() }))
+	m.Set("capacity", expvar.Func(func() interface{} {
+		n := 0
+		for _, lane := range lanes {
+			n += cap(lane)
+		}
+		return n
+	}))
+	m.Set("lanes", expvar.Func(func() interface{} {
+		depths := make([]int, len(lanes))
+		for i, lane := range lanes {
+			depths[i] = len(lane)
+		}
+		return depths
+	}))
+	m.Set("spooled", expvar.Func(func() interface{} {
+		if spill == nil {
+			return 0
+		}
+		return spill.Len()
+	}))
+	m.Set("dropped", &queueVars.dropped)
+	m.Set("spilled", &queueVars.spilled)
+	m.Set("published", &queueVars.published)
+	m.Set("failed", &queueVars.failed)
+}
+
+// startPublishing sets up the queue as configured, then starts the dispatcher on work and the workers
+// Records left in the spool by the last run are published first
+func startPublishing(work chan *gpsparser.Envelope) error {
+	overflow = config.Overflow
+	if overflow == OverflowSpill {
+		var err error
+		if spill, err = spool.Open(config.SpoolDir, config.SpoolSize); err != nil {
+			return err
+		}
+		if n := spill.Len(); n > 0 {
+			log.Noticef("%d records left in the spool %s", n, config.SpoolDir)
+		}
+		spill.SetSync(time.Duration(config.SyncInterval) * time.Millisecond)
+	}
+
+	// The queue is shared out between the lanes
+	size := config.QueueSize / config.Workers
+	if size < 1 {
+		size = 1
+	}
+	lanes = make([]chan *gpsparser.Envelope, config.Workers)
+	for i := range lanes {
+		lanes[i] = make(chan *gpsparser.Envelope, size)
+	}
+
+	publishing.Add(1 + config.Workers)
+	go dispatcher(work)
+	for _, lane := range lanes {
+		go worker(lane)
+	}
+	return nil
+}
+
+// laneOf returns the lane the records of device go to
+func laneOf(device string) chan *gpsparser.Envelope {
+	// FNV-1a, written out so that it does not allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(device); i++ {
+		h ^= uint32(device[i])
+		h *= 16777619
+	}
+	return lanes[h%uint32(len(lanes))]
+}
+
+// queued returns how many records are waiting for a worker
+func queued() int {
+	n := 0
+	for _, lane := range lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// enqueue puts envelope on the lane of its device, applying the overflow policy when the lane is full
+// spilling tells that there are records in the spool, new ones then go after them to keep the order
+func enqueue(envelope *gpsparser.Envelope, spilling bool) {
+	lane := laneOf(envelope.Device)
+	switch overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case lane <- envelope:
+				return
+			default:
+			}
+			// A worker may have taken one in the meantime, then there is nothing to drop
+			select {
+			case <-lane:
+				queueVars.dropped.Add(1)
+			default:
+			}
+		}
+	case OverflowSpill:
+		if !spilling {
+			select {
+			case lane <- envelope:
+				return
+			default:
+			}
+		}
+		record, err := json.Marshal(envelope)
+		if err == nil {
+			err = spill.Push(record)
+		}
+		if err != nil {
+			queueVars.dropped.Add(1)
+			log.Debugf("Record of %s dropped: %s", envelope.Device, err)
+			return
+		}
+		queueVars.spilled.Add(1)
+	default:
+		lane <- envelope
+	}
+}
+
+// unspool takes the oldest record off the spool, nil when there is none
+func unspool() *gpsparser.Envelope {
+	for {
+		record, err := spill.Pop()
+		if err == spool.ErrEmpty {
+			return nil
+		}
+		if err == spool.ErrCorrupt {
+			queueVars.dropped.Add(1)
+			log.Errorf("Spool: %s", err)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Spool: %s", err)
+			return nil
+		}
+		envelope, err := unmarshalEnvelope(record)
+		if err != nil {
+			queueVars.dropped.Add(1)
+			log.Errorf("Spool: %s", err)
+			continue
+		}
+		return envelope
+	}
+}
+
+// unmarshalEnvelope decodes an envelope that was kept on disk as JSON
+func unmarshalEnvelope(record []byte) (*gpsparser.Envelope, error) {
+	envelope := new(gpsparser.Envelope)
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	if err := decoder.Decode(envelope); err != nil {
+		return nil, err
+	}
+	// IO values are int64 or float64, JSON does not tell them apart
+	for key, value := range envelope.Record.IO {
+		if n, ok := value.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				envelope.Record.IO[key] = i
+			} else {
+				envelope.Record.IO[key], _ = n.Float64()
+			}
+		}
+	}
+	return envelope, nil
+}
+
+// worker publishes what is on its lane until it is closed
+// A fixed number of workers is started, so a slow broker fills the queue instead of piling up goroutines
+func worker(lane chan *gpsparser.Envelope) {
+	defer publishing.Done()
+	for envelope := range lane {
+		publish(envelope)
+	}
+}
+
+// publish sends envelope to ThingsBoard, or keeps it in the backlog while the broker cannot be reached
+// Once something is in the backlog everything goes there, so that records are published in the order they came
+func publish(envelope *gpsparser.Envelope) {
+	backlog.Lock()
+	if !mq.Online(c) || backlog.spool.Len() > 0 {
+		storeLocked(envelope)
+		backlog.Unlock()
+		return
+	}
+	backlog.Unlock()
+
+	if err := send(envelope); err != nil {
+		log.Debugf("Record of %s not published, keeping it for later: %s", envelope.Device, err)
+		store(envelope)
+	}
+}
+
+// send encodes the record in envelope and sends it to ThingsBoard through the MQTT Gateway API,
+// connecting its device first if needed (the flat and geojson schemas have no devices to connect)
+// The connect is sent by the same worker right before, so it always reaches ThingsBoard before the device's data
+// It fails when the broker could not be reached, the record can then be sent again
+// Records that cannot be encoded are counted and dropped, sending them again would not help
+func send(envelope *gpsparser.Envelope) error {
+	publications, err := envelope.Publications()
+	if err != nil {
+		queueVars.failed.Add(1)
+		log.Debugf("Record of %s from %s not encoded: %s", envelope.Device, envelope.Conn, err)
+	}
+	if len(publications) == 0 {
+		return nil
+	}
+
+	uniqid := envelope.Device
+	deviceStatus.RLock()
+	currentStatus := deviceStatus.connected[uniqid]
+	deviceStatus.RUnlock()
+	if !currentStatus && publications[0].Gateway {
+		if err := mq.Publish(c, string(gpsparser.ThingsBoardDevice(uniqid)), gpsparser.TopicConnect); err != nil {
+			return err
+		}
+		deviceStatus.Lock()
+		deviceStatus.connected[uniqid] = true
+		deviceStatus.Unlock()
+	}
+	for _, publication := range publications {
+		if err := mq.Publish(c, publication.Payload, publication.Topic); err != nil {
+			queueVars.failed.Add(1)
+			return err
+		}
+		queueVars.published.Add(1)
+	}
+	return nil
+}
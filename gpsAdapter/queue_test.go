@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	spool "github.com/reisub1/go/gpsAdapter/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drain takes every record waiting in lane and returns their devices
+func drain(lane chan *gpsparser.Envelope) []string {
+	var devices []string
+	for {
+		select {
+		case envelope := <-lane:
+			devices = append(devices, envelope.Device)
+		default:
+			return devices
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	defer func() { lanes, overflow, spill = nil, "", nil }()
+
+	tests := []struct {
+		policy   string
+		spilling bool     // Whether the spool already holds records when the last one is enqueued
+		queued   []string // What ends up on the lane, oldest first
+		spilled  []string // What ends up in the spool, oldest first
+		dropped  int64
+	}{
+		{policy: OverflowDropOldest, queued: []string{"b", "c"}, dropped: 1},
+		{policy: OverflowSpill, queued: []string{"a", "b"}, spilled: []string{"c"}},
+		// Once records are in the spool new ones go after them, even when the lane has room
+		{policy: OverflowSpill, spilling: true, queued: []string{"a"}, spilled: []string{"b", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			// A single lane with room for two records
+			lanes = []chan *gpsparser.Envelope{make(chan *gpsparser.Envelope, 2)}
+			overflow, spill = test.policy, nil
+			if test.policy == OverflowSpill {
+				dir, err := ioutil.TempDir("", "gpsAdapter")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+				spill, err = spool.Open(dir, 0)
+				require.NoError(t, err)
+				defer spill.Close()
+			}
+
+			dropped := queueVars.dropped.Value()
+			for i, device := range []string{"a", "b", "c"} {
+				enqueue(&gpsparser.Envelope{Device: device}, test.spilling && i > 0)
+			}
+			assert.Equal(t, test.queued, drain(lanes[0]))
+			var spilled []string
+			if spill != nil {
+				for envelope := unspool(); envelope != nil; envelope = unspool() {
+					spilled = append(spilled, envelope.Device)
+				}
+			}
+			assert.Equal(t, test.spilled, spilled)
+			assert.Equal(t, test.dropped, queueVars.dropped.Value()-dropped)
+		})
+	}
+
+	// Blocking holds the dispatcher back until a worker takes a record
+	t.Run(OverflowBlock, func(t *testing.T) {
+		lanes = []chan *gpsparser.Envelope{make(chan *gpsparser.Envelope, 1)}
+		overflow = OverflowBlock
+		enqueue(&gpsparser.Envelope{Device: "a"}, false)
+		done := make(chan struct{})
+		go func() {
+			enqueue(&gpsparser.Envelope{Device: "b"}, false)
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("enqueue did not block on a full lane")
+		case <-time.After(20 * time.Millisecond):
+		}
+		assert.Equal(t, "a", (<-lanes[0]).Device)
+		<-done
+		assert.Equal(t, []string{"b"}, drain(lanes[0]))
+	})
+}
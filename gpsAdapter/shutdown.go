@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+	mq "github.com/reisub1/go/gpsAdapter/mq"
+)
+
+// This channel is closed when the adapter is asked to stop, every server stops taking data once it is
+var stopping = make(chan struct{})
+
+// The UDP and HTTP servers, which put records on the jsonChan from their own goroutines
+// The jsonChan is only closed once they are all done
+var producers sync.WaitGroup
+
+// The dispatcher and the workers
+var publishing sync.WaitGroup
+
+// shutdown is run once the servers have been asked to stop, it sends what was received before letting go
+// The queued records are sent first (or put in the backlog), then every connected device is disconnected from
+// the gateway, then the MQTT session is closed. Whatever is not done within SHUTDOWNTIMEOUT is given up on,
+// every step counts against that same deadline. The backlog is always flushed to disk before returning
+func shutdown() {
+	deadline := time.NewTimer(SHUTDOWNTIMEOUT)
+	defer deadline.Stop()
+	timedOut := false
+	// wait waits for done until the deadline, which passes only once
+	wait := func(done chan struct{}) bool {
+		if timedOut {
+			select {
+			case <-done:
+				return true
+			default:
+				return false
+			}
+		}
+		select {
+		case <-done:
+			return true
+		case <-deadline.C:
+			timedOut = true
+			return false
+		}
+	}
+
+	// The HTTP server waits for the reports it is handling, at most SHUTDOWNTIMEOUT
+	producers.Wait()
+	log.Noticef("Servers stopped, sending %d queued records", len(jsonChan)+queued())
+	close(jsonChan)
+
+	drained := make(chan struct{})
+	go func() {
+		publishing.Wait()
+		close(drained)
+	}()
+	if !wait(drained) {
+		log.Warningf("Gave up on %d queued records after %s", len(jsonChan)+queued(), SHUTDOWNTIMEOUT)
+	}
+	// Records the workers are still on when it is closed are dropped, they are no worse off than those still queued
+	closeBacklog()
+
+	// ThingsBoard shows the devices as offline right away instead of waiting for them to time out
+	disconnected := make(chan struct{})
+	go func() {
+		deviceStatus.Lock()
+		for device := range deviceStatus.connected {
+			mq.Publish(c, string(gpsparser.ThingsBoardDevice(device)), gpsparser.TopicDisconnect)
+			delete(deviceStatus.connected, device)
+		}
+		deviceStatus.Unlock()
+		close(disconnected)
+	}()
+	if !wait(disconnected) {
+		log.Warningf("Gave up on disconnecting devices after %s", SHUTDOWNTIMEOUT)
+	}
+
+	// Disconnect with 1000 ms time to cleanup
+	(*c).Disconnect(1000)
+	log.Notice("Server closed")
+}
@@ -0,0 +1,422 @@
+// Package spool keeps a FIFO of records on disk, for data that has to outlive a full queue or a restart
+// Records are appended to segment files in a directory, and a segment is removed once every record in it has been read
+// Every record is stored with its length and a CRC, so a record cut short by a crash is found and dropped on Open
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned by Push when the record would make the spool larger than its maximum size
+var ErrFull = errors.New("spool full")
+
+// ErrEmpty is returned by Pop when there is no record left
+var ErrEmpty = errors.New("spool empty")
+
+// ErrCorrupt is returned by Pop and Peek when the oldest segment is damaged
+// The records left in it cannot be found anymore, the segment is dropped and the next call goes on with the next one
+var ErrCorrupt = errors.New("spool: corrupt segment, the records left in it were dropped")
+
+// Every record is preceded by its length and the CRC-32 (IEEE) of its data, both big endian
+const headerSize = 8
+
+// Segments are not written to anymore once they grow past this many bytes, so read ones can be removed
+var segmentSize int64 = 1 << 20
+
+// The file holding where reading stopped when the spool was last closed
+const headFile = "head"
+
+// Spool is a FIFO of records kept in a directory, it is safe for concurrent use
+// Records read since the last Close are read again after a crash, so records may be read twice
+// Records pushed are flushed to disk on every Push, or at most the interval given to SetSync after it
+type Spool struct {
+	mu       sync.Mutex
+	dir      string
+	max      int64
+	segments []int // Sequence numbers of the segment files, oldest first
+	next     int   // Sequence number of the next segment to create
+
+	// The segment being written, the last of segments
+	w     *os.File
+	wsize int64
+
+	// The segment being read, the first of segments
+	r    *os.File
+	roff int64
+
+	size  int64 // Bytes of the records not read yet, headers included
+	count int   // Records not read yet
+
+	sync  time.Duration // Longest a pushed record waits to be flushed to disk, 0 to flush on every Push
+	flush *time.Timer   // Pending flush of the segment being written, nil when it is flushed
+}
+
+// Open opens the spool in dir, creating dir if needed, and finds the records left in it
+// The spool refuses records that would make it larger than max bytes, 0 for no limit
+func Open(dir string, max int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, max: max, next: 1}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, ".seg"))
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Ints(s.segments)
+
+	// Where reading stopped when the spool was last closed, segments before that have been read
+	// Sequence numbers are never reused, so an old head cannot point into a newer segment
+	headSeq, headOff := s.readHead()
+	for len(s.segments) > 0 && s.segments[0] < headSeq {
+		os.Remove(s.path(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0] != headSeq {
+		headOff = 0
+	}
+	if headSeq >= s.next {
+		s.next = headSeq + 1
+	}
+
+	for i, seq := range s.segments {
+		start := int64(0)
+		if i == 0 {
+			start = headOff
+		}
+		if err := s.scan(seq, start); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.next = seq + 1
+	}
+	if len(s.segments) > 0 {
+		s.roff = headOff
+	}
+	return s, nil
+}
+
+// readHead reads the head file, it returns 0, 0 when there is none
+func (s *Spool) readHead() (seq int, off int64) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, headFile))
+	if err != nil {
+		return 0, 0
+	}
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &off); err != nil {
+		return 0, 0
+	}
+	return seq, off
+}
+
+// scan counts the records of segment seq from start, and cuts the segment at the first record that is not whole
+func (s *Spool) scan(seq int, start int64) error {
+	f, err := os.OpenFile(s.path(seq), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Truncate(s.countRecords(f, start))
+}
+
+// countRecords counts the whole records of f from start, and returns where they end
+func (s *Spool) countRecords(f *os.File, start int64) int64 {
+	off := start
+	for {
+		data, err := readRecord(f, off)
+		if err != nil {
+			return off
+		}
+		off += headerSize + int64(len(data))
+		s.size += headerSize + int64(len(data))
+		s.count++
+	}
+}
+
+// readRecord reads the record at off in f
+// It returns io.EOF when off is the end of f, and ErrCorrupt when what is at off is not a whole record
+func readRecord(f *os.File, off int64) ([]byte, error) {
+	var header [headerSize]byte
+	if n, err := f.ReadAt(header[:], off); err != nil {
+		if err == io.EOF && n > 0 {
+			return nil, ErrCorrupt
+		}
+		return nil, err
+	}
+	// A damaged length could ask for up to 4 GiB, it has to fit in what is left of f before anything is allocated
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > info.Size()-off-headerSize {
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, off+headerSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+func (s *Spool) path(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d.seg", seq))
+}
+
+// Push appends record to the spool
+// It returns ErrFull without writing anything when the record does not fit in the maximum size
+func (s *Spool) Push(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := headerSize + int64(len(record))
+	if s.max > 0 && s.size+n > s.max {
+		return ErrFull
+	}
+
+	if s.w == nil || s.wsize >= segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// Header and data in a single write, so a crash cuts the record instead of leaving a header alone
+	b := make([]byte, headerSize, n)
+	binary.BigEndian.PutUint32(b[:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(record))
+	b = append(b, record...)
+	if _, err := s.w.Write(b); err != nil {
+		// Whatever part of the record was written is cut off by the next Open
+		return err
+	}
+	s.wsize += n
+	s.size += n
+	s.count++
+
+	if s.sync == 0 {
+		return s.w.Sync()
+	}
+	if s.flush == nil {
+		s.flush = time.AfterFunc(s.sync, s.flushNow)
+	}
+	return nil
+}
+
+// SetSync lets records pushed from now on wait up to d before they are flushed to disk, so that a burst of them
+// is flushed at once. Records waiting are lost in a crash of the machine, 0 flushes on every Push, the default
+func (s *Spool) SetSync(d time.Duration) {
+	s.mu.Lock()
+	s.sync = d
+	s.mu.Unlock()
+}
+
+// flushNow flushes the segment being written, it is run by the timer started by Push
+func (s *Spool) flushNow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush = nil
+	if s.w != nil {
+		s.w.Sync()
+	}
+}
+
+// stopFlush flushes the segment being written right away instead of waiting for the timer
+func (s *Spool) stopFlush() error {
+	if s.flush == nil {
+		return nil
+	}
+	s.flush.Stop()
+	s.flush = nil
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Sync()
+}
+
+// rotate starts writing to a new segment
+// The last segment found by Open is not appended to, it could end in a record that was cut short
+func (s *Spool) rotate() error {
+	if s.w != nil {
+		s.stopFlush()
+		s.w.Close()
+	}
+	seq := s.next
+	w, err := os.OpenFile(s.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		s.w = nil
+		return err
+	}
+	s.w, s.wsize = w, 0
+	s.next++
+	s.segments = append(s.segments, seq)
+	return nil
+}
+
+// Pop removes the oldest record from the spool and returns it, or returns ErrEmpty
+func (s *Spool) Pop() ([]byte, error) {
+	return s.read(true)
+}
+
+// Peek returns the oldest record without removing it, or returns ErrEmpty
+// Pop it once it has been dealt with, so that it is not lost when that fails
+func (s *Spool) Peek() ([]byte, error) {
+	return s.read(false)
+}
+
+// read returns the oldest record, removing it from the spool if remove is set
+func (s *Spool) read(remove bool) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.count > 0 {
+		if s.r == nil {
+			r, err := os.Open(s.path(s.segments[0]))
+			if err != nil {
+				return nil, err
+			}
+			s.r = r
+		}
+
+		data, err := readRecord(s.r, s.roff)
+		if err == nil && !remove {
+			return data, nil
+		}
+		if err == nil {
+			s.roff += headerSize + int64(len(data))
+			s.size -= headerSize + int64(len(data))
+			s.count--
+			if s.count == 0 {
+				s.clear()
+			}
+			return data, nil
+		}
+		if err == ErrCorrupt {
+			s.dropCorrupt()
+			return nil, err
+		}
+
+		// The end of a segment, the records go on in the next one
+		if len(s.segments) == 1 || err != io.EOF {
+			return nil, err
+		}
+		s.r.Close()
+		s.r, s.roff = nil, 0
+		os.Remove(s.path(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	return nil, ErrEmpty
+}
+
+// dropCorrupt drops the segment being read, and counts the records left in the other ones again
+// How many records the dropped segment still held is not known, its lengths cannot be trusted
+func (s *Spool) dropCorrupt() {
+	if len(s.segments) == 1 {
+		s.clear()
+		return
+	}
+	s.r.Close()
+	s.r, s.roff = nil, 0
+	os.Remove(s.path(s.segments[0]))
+	s.segments = s.segments[1:]
+
+	// The segment being written is only read here, cutting it would leave a hole where the next record is written
+	s.size, s.count = 0, 0
+	for _, seq := range s.segments {
+		if f, err := os.Open(s.path(seq)); err == nil {
+			s.countRecords(f, 0)
+			f.Close()
+		}
+	}
+	if s.count == 0 {
+		s.clear()
+	}
+}
+
+// clear removes every segment once all records have been read, so an empty spool takes no disk space
+func (s *Spool) clear() {
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+	if s.r != nil {
+		s.r.Close()
+	}
+	if s.w != nil {
+		s.w.Close()
+	}
+	for _, seq := range s.segments {
+		os.Remove(s.path(seq))
+	}
+	s.r, s.roff, s.w, s.wsize = nil, 0, nil, 0
+	s.segments = nil
+	s.size, s.count = 0, 0
+}
+
+// Len returns the number of records not read yet
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Size returns the bytes taken by the records not read yet
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Close flushes the spool to disk and remembers where reading stopped, so the next Open starts from there
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.flush != nil {
+		s.flush.Stop()
+		s.flush = nil
+	}
+	var err error
+	if s.w != nil {
+		err = s.w.Sync()
+		s.w.Close()
+		s.w = nil
+	}
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	// With nothing left the previous head is kept as it is, Open only needs its sequence number then
+	if len(s.segments) > 0 {
+		head := fmt.Sprintf("%d %d", s.segments[0], s.roff)
+		if werr := ioutil.WriteFile(filepath.Join(s.dir, headFile), []byte(head), 0600); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Small segments, so that records are spread over several of them
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	segmentSize = 64
+
+	s, err := Open(dir, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = s.Pop()
+	assert.Equal(ErrEmpty, err)
+
+	// Records come out in the order they went in, across segments
+	for i := 0; i < 20; i++ {
+		assert.NoError(s.Push([]byte(fmt.Sprintf("record %d", i))))
+	}
+	assert.Equal(20, s.Len())
+	record, err := s.Peek()
+	assert.NoError(err)
+	assert.Equal("record 0", string(record))
+	assert.Equal(20, s.Len())
+	assert.Equal(int64(10*16+10*17), s.Size())
+	for i := 0; i < 5; i++ {
+		record, err := s.Pop()
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("record %d", i), string(record))
+	}
+
+	// A clean Close remembers where reading stopped
+	assert.NoError(s.Close())
+	s, err = Open(dir, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(15, s.Len())
+	record, err = s.Pop()
+	assert.NoError(err)
+	assert.Equal("record 5", string(record))
+
+	// After a crash the last record written can be cut short, it is dropped and the rest is kept
+	assert.NoError(s.Push([]byte("record 20")))
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	last := segments[len(segments)-1]
+	info, _ := os.Stat(last)
+	assert.NoError(os.Truncate(last, info.Size()-3))
+	s, err = Open(dir, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	// Without a Close, records read since the last one are read again
+	assert.Equal(15, s.Len())
+	for i := 5; i < 20; i++ {
+		record, err := s.Pop()
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("record %d", i), string(record))
+	}
+	_, err = s.Pop()
+	assert.Equal(ErrEmpty, err)
+
+	// Reading everything leaves no segment behind
+	segments, _ = filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.Empty(segments)
+	assert.NoError(s.Close())
+
+	// The spool does not grow past its maximum size
+	s, err = Open(dir, 40)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(s.Push([]byte("record 0")))
+	assert.NoError(s.Push([]byte("record 1")))
+	assert.Equal(ErrFull, s.Push([]byte("record 2")))
+	assert.Equal(2, s.Len())
+	assert.NoError(s.Close())
+}
+
+func TestSpoolSync(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	// A burst of records is flushed once, after the interval
+	s.SetSync(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.NoError(s.Push([]byte(fmt.Sprintf("record %d", i))))
+	}
+	s.mu.Lock()
+	assert.NotNil(s.flush)
+	s.mu.Unlock()
+	assert.Eventually(func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.flush == nil
+	}, time.Second, time.Millisecond)
+
+	// Close flushes right away
+	assert.NoError(s.Push([]byte("record 5")))
+	assert.NoError(s.Close())
+	s, err = Open(dir, 0)
+	if assert.NoError(err) {
+		assert.Equal(6, s.Len())
+		assert.NoError(s.Close())
+	}
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Four records in every segment, records 10 and up take 17 bytes instead of 16
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	segmentSize = 64
+
+	// damage overwrites the segment seq at off with b
+	damage := func(seq int, off int64, b ...byte) {
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%010d.seg", seq)), os.O_WRONLY, 0600)
+		if assert.NoError(err) {
+			_, err = f.WriteAt(b, off)
+			assert.NoError(err)
+			assert.NoError(f.Close())
+		}
+	}
+
+	s, err := Open(dir, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < 20; i++ {
+		assert.NoError(s.Push([]byte(fmt.Sprintf("record %d", i))))
+	}
+
+	// A length of 4 GiB is not allocated, the rest of the segment is dropped and reading goes on with the next one
+	damage(1, 16, 0xff, 0xff, 0xff, 0xff)
+	record, err := s.Pop()
+	assert.NoError(err)
+	assert.Equal("record 0", string(record))
+	_, err = s.Peek()
+	assert.Equal(ErrCorrupt, err)
+	assert.Equal(16, s.Len())
+	assert.Equal(int64(6*16+10*17), s.Size())
+	record, err = s.Pop()
+	assert.NoError(err)
+	assert.Equal("record 4", string(record))
+
+	// A bad CRC in the segment being written drops what is left of it
+	damage(5, 2*17+4, 0)
+	for i := 5; i < 18; i++ {
+		record, err = s.Pop()
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("record %d", i), string(record))
+	}
+	_, err = s.Pop()
+	assert.Equal(ErrCorrupt, err)
+	assert.Equal(0, s.Len())
+	_, err = s.Pop()
+	assert.Equal(ErrEmpty, err)
+
+	// A damaged length found by Open cuts the segment there
+	for i := 0; i < 3; i++ {
+		assert.NoError(s.Push([]byte(fmt.Sprintf("record %d", i))))
+	}
+	assert.NoError(s.Close())
+	damage(6, 16, 0xff, 0xff, 0xff, 0xff)
+	s, err = Open(dir, 0)
+	if assert.NoError(err) {
+		assert.Equal(1, s.Len())
+		assert.NoError(s.Close())
+	}
+}
@@ -0,0 +1,92 @@
+// Package stream reassembles whole frames out of a TCP byte stream
+// TCP gives no guarantee that one read holds exactly one frame, a frame can be split over several reads
+// and several frames can arrive in one read. A Buffer keeps whatever is left over until the rest arrives
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+)
+
+// ErrFrameTooLong is returned when more than the maximum frame size arrives without a frame being completed
+var ErrFrameTooLong = errors.New("frame too long")
+
+// Buffer holds the bytes received on one connection that do not make up a whole frame yet
+// A Buffer is not safe for concurrent use, each connection gets its own
+type Buffer struct {
+	pending []byte
+	split   bufio.SplitFunc
+	max     int
+}
+
+// NewBuffer returns a buffer that cuts frames with split and allows frames of at most max bytes
+func NewBuffer(split bufio.SplitFunc, max int) *Buffer {
+	return &Buffer{split: split, max: max}
+}
+
+// Write adds p to the stream and calls frame with every frame that is now complete, in order
+// The frames passed to frame are only valid until it returns
+// On error the buffered data is thrown away, the connection should be closed as it can no longer be trusted
+func (b *Buffer) Write(p []byte, frame func([]byte)) error {
+	// Nothing left over, the frames can be cut straight out of p without copying it
+	data := p
+	if len(b.pending) > 0 {
+		b.pending = append(b.pending, p...)
+		data = b.pending
+	}
+
+	for len(data) > 0 {
+		advance, token, err := b.split(data, false)
+		if err != nil {
+			b.Reset()
+			return err
+		}
+		if advance == 0 {
+			break
+		}
+		if len(token) > b.max {
+			b.Reset()
+			return ErrFrameTooLong
+		}
+		if token != nil {
+			frame(token)
+		}
+		data = data[advance:]
+	}
+
+	// Keep the incomplete tail for the next Write
+	if len(data) > b.max {
+		b.Reset()
+		return ErrFrameTooLong
+	}
+	b.pending = append(b.pending[:0], data...)
+	return nil
+}
+
+// Buffered returns the number of bytes waiting for the rest of their frame
+func (b *Buffer) Buffered() int {
+	return len(b.pending)
+}
+
+// Reset throws away any buffered data
+func (b *Buffer) Reset() {
+	b.pending = b.pending[:0]
+}
+
+// SplitText is a bufio.SplitFunc for the text protocols, whose frames end in # or a newline
+// The terminator is kept in the frame and frames holding nothing but whitespace are skipped
+func SplitText(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	i := bytes.IndexAny(data, "#\n")
+	if i < 0 {
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	frame := data[:i+1]
+	if len(bytes.TrimSpace(frame)) == 0 {
+		return i + 1, nil, nil
+	}
+	return i + 1, frame, nil
+}
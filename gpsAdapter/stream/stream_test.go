@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffer(t *testing.T) {
+	assert := assert.New(t)
+	b := NewBuffer(SplitText, 64)
+
+	var frames []string
+	collect := func(frame []byte) { frames = append(frames, string(frame)) }
+
+	// A frame split over several reads
+	assert.NoError(b.Write([]byte("*ZJ,2030295119,V1,"), collect))
+	assert.Empty(frames)
+	assert.Equal(18, b.Buffered())
+	assert.NoError(b.Write([]byte("062804#\n"), collect))
+	assert.Equal([]string{"*ZJ,2030295119,V1,062804#"}, frames)
+	assert.Equal(0, b.Buffered())
+
+	// Several frames in one read, with a partial one at the end
+	frames = nil
+	assert.NoError(b.Write([]byte("GTPL $9,1#GTPL $4,2#\nGTPL $5"), collect))
+	assert.Equal([]string{"GTPL $9,1#", "GTPL $4,2#"}, frames)
+	assert.Equal(7, b.Buffered())
+	frames = nil
+	assert.NoError(b.Write([]byte(",3#"), collect))
+	assert.Equal([]string{"GTPL $5,3#"}, frames)
+
+	// Frames are not allowed to grow past the maximum frame size
+	assert.Equal(ErrFrameTooLong, b.Write(make([]byte, 65), collect))
+	assert.Equal(0, b.Buffered())
+	assert.NoError(b.Write(make([]byte, 60), collect))
+	assert.Equal(ErrFrameTooLong, b.Write(append(make([]byte, 10), '#'), collect))
+	assert.Equal(0, b.Buffered())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	gpsparser "github.com/reisub1/go/gpsAdapter/gpsparser"
+)
+
+// A device sending over UDP, there is no connection to keep its parser on so it is kept by address
+type udpDevice struct {
+	parser   *gpsparser.Parser
+	lastSeen time.Time
+}
+
+// serveUDP takes datagrams for the UDP listener l, it runs until the listener fails or the adapter stops
+// Every datagram holds whole frames, which are parsed within the session of the address they came from
+// Replies (ACKs) are sent back to that same address
+func serveUDP(l *Listener) {
+	defer producers.Done()
+
+	conn, err := net.ListenPacket("udp", l.Addr)
+	if err != nil {
+		log.Critical(err)
+		return
+	}
+	log.Noticef("server started on %s", l)
+
+	// Closing the socket is what gets ReadFrom to return
+	go func() {
+		<-stopping
+		conn.Close()
+	}()
+
+	// Only this goroutine touches devices, so it needs no lock
+	devices := make(map[string]*udpDevice)
+	lastSweep := time.Now()
+
+	// One byte more than a frame may have, to tell when a datagram is too long
+	buf := make([]byte, MAXFRAMESIZE+1)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-stopping:
+				log.Noticef("server stopped on %s", l)
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Critical(err)
+			return
+		}
+		now := time.Now()
+
+		// Forget devices that went quiet, their address may belong to someone else by now
+		if now.Sub(lastSweep) > UDPSESSIONTIMEOUT {
+			for key, device := range devices {
+				if now.Sub(device.lastSeen) > UDPSESSIONTIMEOUT {
+					delete(devices, key)
+				}
+			}
+			lastSweep = now
+			l.metrics.open.Set(int64(len(devices)))
+		}
+
+		l.metrics.bytes.Add(int64(n))
+		if n > MAXFRAMESIZE {
+			l.metrics.dropped.Add(1)
+			log.Warningf("UDP %s: datagram longer than %d bytes dropped", remote, MAXFRAMESIZE)
+			continue
+		}
+		l.metrics.frames.Add(1)
+
+		key := remote.String()
+		device := devices[key]
+		if device == nil {
+			device = &udpDevice{parser: l.newParser(key, "udp/"+key)}
+			devices[key] = device
+			l.metrics.connections.Add(1)
+			l.metrics.open.Set(int64(len(devices)))
+		}
+		device.lastSeen = now
+
+		errs, ok := l.publish(device.parser, buf[:n])
+		if !ok {
+			// There is no connection to close, the session of the address is forgotten instead
+			delete(devices, key)
+			l.metrics.dropped.Add(1)
+			l.metrics.open.Set(int64(len(devices)))
+			continue
+		}
+		for _, err := range errs {
+			log.Debugf("UDP %s: %s", key, err)
+		}
+		if reply := device.parser.Session.Reply(); len(reply) > 0 {
+			if _, err := conn.WriteTo(reply, remote); err != nil {
+				log.Warningf("UDP %s: %s", key, err)
+			}
+		}
+	}
+}